@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// shorthands maps each shorthand flag to its long name. Config files only
+// accept long names, and a shorthand given on the command line counts as
+// setting its long flag.
+var shorthands = map[string]string{
+	"p": "port",
+	"w": "watch",
+	"v": "verbose",
+	"i": "ignore",
+	"q": "quiet",
+}
+
+// configAliases maps the older config keys still accepted to the long flag
+// names that replaced them.
+var configAliases = map[string]string{
+	"watchDir":   "watch",
+	"ignoreList": "ignore",
+}
+
+// loadConfig reads a JSON or YAML config file whose keys are long flag names,
+// e.g. "port", "watch", "verbose" and "ignore", or one of configAliases.
+// Files ending in .json are parsed as JSON, everything else as YAML. An empty
+// file is a valid, empty config; unknown keys are reported as errors, naming
+// the flag meant when a camelCase key matches one.
+func loadConfig(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+	values := map[string]any{}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return values, nil
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		// Numbers stay as written; as float64 1048576 would print as 1.048576e+06
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		err = dec.Decode(&values)
+	} else {
+		err = yaml.Unmarshal(data, &values)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	for key, value := range values {
+		long, ok := configAliases[key]
+		if !ok {
+			continue
+		}
+		if _, both := values[long]; both {
+			return nil, fmt.Errorf("config file %s sets both %q and its newer name %q", path, key, long)
+		}
+		delete(values, key)
+		values[long] = value
+	}
+	for key := range values {
+		if _, short := shorthands[key]; short || key == "config" || flag.Lookup(key) == nil {
+			if long := kebabCase(key); long != key && flag.Lookup(long) != nil {
+				return nil, fmt.Errorf("unknown key %q in config file %s, did you mean %q? (keys are long flag names, see -help)", key, path, long)
+			}
+			return nil, fmt.Errorf("unknown key %q in config file %s (keys are long flag names, see -help)", key, path)
+		}
+	}
+	return values, nil
+}
+
+// kebabCase turns a camelCase key such as "maxClients" into the flag
+// spelling "max-clients".
+func kebabCase(key string) string {
+	var b strings.Builder
+	for _, r := range key {
+		if unicode.IsUpper(r) {
+			b.WriteByte('-')
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// applyConfig sets each config value on its flag, skipping flags in skip,
+// i.e. those already given on the command line or in the environment. List
+// values are applied one entry at a time so they accumulate like repeated flags.
+func applyConfig(values map[string]any, skip map[string]bool) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if skip[key] {
+			continue
+		}
+		items, ok := values[key].([]any)
+		if !ok {
+			items = []any{values[key]}
+		}
+		for _, item := range items {
+			switch item.(type) {
+			case map[string]any, []any:
+				return fmt.Errorf("config key %q: expected a value or a list of values", key)
+			}
+			if err := flag.Set(key, fmt.Sprint(item)); err != nil {
+				return fmt.Errorf("config key %q: %w", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// explicitFlags returns the long names of the flags given on the command line.
+// A shorthand like -p counts as its long flag.
+func explicitFlags() map[string]bool {
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		if long, ok := shorthands[f.Name]; ok {
+			explicit[long] = true
+		}
+		explicit[f.Name] = true
+	})
+	return explicit
+}
+
+// envName returns the environment variable for a long flag name, e.g.
+// REFRESH_PORT for -port and REFRESH_ALLOWED_ORIGINS for -allowed-origins.
+func envName(name string) string {
+	return "REFRESH_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// envAliases maps long flag names to conventional environment variables
+// read when the flag's REFRESH_* variable isn't set, such as the $PORT that
+// platforms like Heroku and Cloud Run inject.
+var envAliases = map[string]string{
+	"port": "PORT",
+}
+
+// applyEnv sets every long flag not in skip from its REFRESH_* environment
+// variable or, failing that, its entry in envAliases. Values loaded from .env
+// count. Flags it sets are added to skip so a config file applied afterwards
+// doesn't override them.
+func applyEnv(skip map[string]bool) error {
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if _, short := shorthands[f.Name]; short || skip[f.Name] || err != nil {
+			return
+		}
+		name := envName(f.Name)
+		value, ok := os.LookupEnv(name)
+		if alias, aliased := envAliases[f.Name]; !ok && aliased {
+			name = alias
+			value, ok = os.LookupEnv(alias)
+		}
+		if !ok {
+			return
+		}
+		if setErr := flag.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("%s: %w", name, setErr)
+			return
+		}
+		skip[f.Name] = true
+	})
+	return err
+}
+
+// secretFlags lists the flags whose values printConfig hides, so the output
+// can be pasted into a bug report.
+var secretFlags = map[string]bool{
+	"auth-token":    true,
+	"trigger-token": true,
+}
+
+// printConfig writes the resolved value of every long flag to w as JSON,
+// after defaults, the config file, the environment and the command line have
+// all been applied. File options such as -tls-key are printed as paths; their
+// contents are never read. Set secretFlags are printed as "***".
+func printConfig(w io.Writer) error {
+	values := map[string]any{}
+	flag.VisitAll(func(f *flag.Flag) {
+		if _, short := shorthands[f.Name]; short || f.Name == "print-config" {
+			return
+		}
+		if secretFlags[f.Name] && f.Value.String() != "" {
+			values[f.Name] = "***"
+			return
+		}
+		switch v := f.Value.(type) {
+		case *stringSlice:
+			values[f.Name] = append([]string{}, *v...)
+		case flag.Getter:
+			if _, isDuration := v.Get().(time.Duration); isDuration {
+				values[f.Name] = v.String()
+			} else {
+				values[f.Name] = v.Get()
+			}
+		default:
+			values[f.Name] = v.String()
+		}
+	})
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(values)
+}
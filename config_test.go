@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nooooaaaaah/RefreshMeDaddy/livereload"
+)
+
+// newTestFlags replaces the global flag set with a fresh one holding every
+// flag, restoring the original when the test ends, and returns the options
+// the flags write to.
+func newTestFlags(t *testing.T) *options {
+	t.Helper()
+	saved := flag.CommandLine
+	t.Cleanup(func() { flag.CommandLine = saved })
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	var opts options
+	defineFlags(&opts)
+	return &opts
+}
+
+// writeConfig writes content to a config file called name in a temporary
+// directory and returns its path.
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name, file, content string
+		readBuffer          int
+		watch, ignore       []string
+	}{
+		{
+			name:       "json large number",
+			file:       "refresh.json",
+			content:    `{"read-buffer": 1048576}`,
+			readBuffer: 1048576,
+		},
+		{
+			name:       "yaml large number",
+			file:       "refresh.yaml",
+			content:    "read-buffer: 1048576\n",
+			readBuffer: 1048576,
+		},
+		{
+			name:    "json aliases",
+			file:    "refresh.json",
+			content: `{"watchDir": "web", "ignoreList": ["node_modules", "*.tmp"]}`,
+			watch:   []string{"web"},
+			ignore:  []string{"node_modules", "*.tmp"},
+		},
+		{
+			name:    "yaml aliases",
+			file:    "refresh.yaml",
+			content: "watchDir: web\nignoreList:\n  - node_modules\n",
+			watch:   []string{"web"},
+			ignore:  []string{"node_modules"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := newTestFlags(t)
+			values, err := loadConfig(writeConfig(t, tt.file, tt.content))
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+			if err := applyConfig(values, nil); err != nil {
+				t.Fatalf("applyConfig: %v", err)
+			}
+			if tt.readBuffer != 0 && opts.server.ReadBufferSize != tt.readBuffer {
+				t.Errorf("ReadBufferSize = %d, want %d", opts.server.ReadBufferSize, tt.readBuffer)
+			}
+			if tt.watch != nil && !reflect.DeepEqual(opts.server.WatchDirs, tt.watch) {
+				t.Errorf("WatchDirs = %q, want %q", opts.server.WatchDirs, tt.watch)
+			}
+			if tt.ignore != nil && !reflect.DeepEqual(opts.server.Ignore, tt.ignore) {
+				t.Errorf("Ignore = %q, want %q", opts.server.Ignore, tt.ignore)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name, content, want string
+	}{
+		{"unknown key", `{"colour": "red"}`, `unknown key "colour"`},
+		{"camelCase key", `{"maxClients": 3}`, `did you mean "max-clients"?`},
+		{"shorthand", `{"p": "3001"}`, `unknown key "p"`},
+		{"alias and long name", `{"watchDir": "web", "watch": "src"}`, `sets both "watchDir" and its newer name "watch"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestFlags(t)
+			_, err := loadConfig(writeConfig(t, "refresh.json", tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("loadConfig error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrintConfigRedactsTokens(t *testing.T) {
+	newTestFlags(t)
+	if err := flag.Set("auth-token", "s3cret-auth"); err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if err := printConfig(&out); err != nil {
+		t.Fatal(err)
+	}
+	var values map[string]any
+	if err := json.Unmarshal([]byte(out.String()), &values); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "s3cret-auth") {
+		t.Errorf("printConfig output contains the auth token:\n%s", out.String())
+	}
+	if values["auth-token"] != "***" {
+		t.Errorf("auth-token = %v, want %q", values["auth-token"], "***")
+	}
+	if values["trigger-token"] != "" {
+		t.Errorf("unset trigger-token = %v, want an empty string", values["trigger-token"])
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	opts := newTestFlags(t)
+	t.Setenv("REFRESH_PORT", "4000")
+	t.Setenv("REFRESH_VERBOSE", "true")
+	t.Setenv("REFRESH_IGNORE", "node_modules, *.tmp")
+	t.Setenv("REFRESH_ALLOWED_ORIGINS", "http://localhost:3000")
+	t.Setenv("REFRESH_DEBOUNCE", "250ms")
+	// Given on the command line, so the environment must not override it
+	if err := flag.CommandLine.Parse([]string{"-debounce", "1s"}); err != nil {
+		t.Fatal(err)
+	}
+	skip := explicitFlags()
+	if err := applyEnv(skip); err != nil {
+		t.Fatalf("applyEnv: %v", err)
+	}
+
+	cfg := opts.server
+	if cfg.Port != "4000" {
+		t.Errorf("Port = %q, want 4000", cfg.Port)
+	}
+	if !cfg.Verbose {
+		t.Error("Verbose not set from REFRESH_VERBOSE")
+	}
+	if want := []string{"node_modules", "*.tmp"}; !reflect.DeepEqual(cfg.Ignore, want) {
+		t.Errorf("Ignore = %q, want %q", cfg.Ignore, want)
+	}
+	if want := []string{"http://localhost:3000"}; !reflect.DeepEqual(cfg.AllowedOrigins, want) {
+		t.Errorf("AllowedOrigins = %q, want %q", cfg.AllowedOrigins, want)
+	}
+	if cfg.Debounce != time.Second {
+		t.Errorf("Debounce = %s, want the command line's 1s", cfg.Debounce)
+	}
+	for _, name := range []string{"port", "verbose", "ignore", "allowed-origins"} {
+		if !skip[name] {
+			t.Errorf("%s not marked as set, so a config file could override it", name)
+		}
+	}
+}
+
+func TestApplyEnvInvalidValue(t *testing.T) {
+	newTestFlags(t)
+	t.Setenv("REFRESH_DEBOUNCE", "soon")
+	err := applyEnv(map[string]bool{})
+	if err == nil || !strings.Contains(err.Error(), "REFRESH_DEBOUNCE") {
+		t.Fatalf("applyEnv error = %v, want one naming REFRESH_DEBOUNCE", err)
+	}
+}
+
+// unsetenv removes key from the environment for the rest of the test.
+func unsetenv(t *testing.T, key string) {
+	t.Helper()
+	t.Setenv(key, "") // Restores the original value afterwards
+	os.Unsetenv(key)
+}
+
+func TestApplyEnvPortAlias(t *testing.T) {
+	tests := []struct {
+		name           string
+		refresh, plain string // REFRESH_PORT and PORT, "" for unset
+		args           []string
+		want           string
+	}{
+		{"PORT alone", "", "5000", nil, "5000"},
+		{"REFRESH_PORT wins", "4000", "5000", nil, "4000"},
+		{"flag wins", "", "5000", []string{"-port", "6000"}, "6000"},
+		{"neither set", "", "", nil, livereload.DefaultPort},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := newTestFlags(t)
+			for key, value := range map[string]string{"REFRESH_PORT": tt.refresh, "PORT": tt.plain} {
+				if value == "" {
+					unsetenv(t, key)
+				} else {
+					t.Setenv(key, value)
+				}
+			}
+			if err := flag.CommandLine.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if err := applyEnv(explicitFlags()); err != nil {
+				t.Fatalf("applyEnv: %v", err)
+			}
+			if opts.server.Port != tt.want {
+				t.Errorf("Port = %q, want %q", opts.server.Port, tt.want)
+			}
+		})
+	}
+}
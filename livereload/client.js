@@ -0,0 +1,275 @@
+// RefreshMeDaddy live-reload client, served at <path>.js (/refreshMeDaddy.js by default).
+// Include it with <script src="http://localhost:8080/refreshMeDaddy.js"></script>.
+(function () {
+  // The server fills in its configured endpoint path when serving the script
+  var endpoint = "/refreshMeDaddy" /* path */;
+  var script = document.currentScript;
+  var base = new URL(script ? script.src : endpoint + ".js", window.location.href);
+  var url = (base.protocol === "https:" ? "wss://" : "ws://") + base.host + endpoint;
+  var pollURL = base.protocol + "//" + base.host + endpoint + "/poll";
+  // With -auth-token, the token comes from the script URL (?token=...) and is
+  // passed on to every request
+  var token = base.searchParams.get("token");
+  // Sequence number of the last reload this page has seen; the server fills it
+  // in when serving the script and catches us up on reconnect if it moved on
+  var seq = 0 /* seq */;
+  // Plain-text reload message, in case the server was started with -reload-message
+  var reloadText = "reload" /* reload message */;
+  // Optional data-paths="app-a/,shared/" limits reloads to changes under those
+  // paths, relative to the watch directory
+  var paths = script && script.getAttribute("data-paths");
+  // Reconnect backoff in milliseconds, adjustable with ?initialBackoff= and
+  // ?maxBackoff= on the script URL
+  var initialDelay = backoffParam("initialBackoff", 500);
+  var maxDelay = Math.max(backoffParam("maxBackoff", 10000), initialDelay);
+  var delay = initialDelay;
+  // Whether a WebSocket has ever opened; opening another after it closed
+  // means the server went away, most likely to restart
+  var connectedBefore = false;
+  // Whether to reload once reconnected after losing the server, since a
+  // restart usually means its code changed; off with -no-reconnect-reload
+  var reloadOnReconnect = true /* reload on reconnect */;
+
+  // backoffParam reads a positive number of milliseconds from the script URL
+  function backoffParam(name, fallback) {
+    var value = parseInt(base.searchParams.get(name), 10);
+    return value > 0 ? value : fallback;
+  }
+
+  // parse accepts both plain-text and JSON (-json-messages) payloads. Plain
+  // text may carry the changed path after a space (-append-path).
+  function parse(data) {
+    if (data.charAt(0) === "{") {
+      try {
+        return JSON.parse(data);
+      } catch (e) {}
+    }
+    if (data === reloadText || data.indexOf(reloadText + " ") === 0) {
+      return { type: "reload", path: data.slice(reloadText.length + 1) };
+    }
+    var space = data.indexOf(" ");
+    if (space === -1) {
+      return { type: data };
+    }
+    return { type: data.slice(0, space), path: data.slice(space + 1) };
+  }
+
+  // logChanges notes in the console which files triggered a reload, when the
+  // server said
+  function logChanges(msg) {
+    var files = msg.files || msg.paths || (msg.path ? [msg.path] : []);
+    if (files.length > 0) {
+      console.log("[RefreshMeDaddy] reloading after changes to " + files.join(", "));
+    }
+  }
+
+  function handle(msg) {
+    if (msg.seq) {
+      seq = msg.seq;
+    }
+    if (msg.type === "connected") {
+      console.log("[RefreshMeDaddy] connected to " + url);
+    } else if (msg.type === "css") {
+      swapStylesheets(msg.path);
+    } else if (msg.type === "reload") {
+      logChanges(msg);
+      reloadPage(msg);
+    } else if (msg.type === "js-update") {
+      updateModule(msg.path);
+    } else if (msg.type === "deleted") {
+      console.warn("[RefreshMeDaddy] " + msg.path + " was deleted, reloading");
+      reloadPage(msg);
+    } else if (msg.type === "hard-reload") {
+      logChanges(msg);
+      hardReload(msg);
+    }
+  }
+
+  // reloadPage reloads the page, or with -cache-bust navigates to its URL
+  // with a fresh _reload query parameter so a page the browser caches
+  // aggressively is fetched again. Replacing the history entry keeps Back
+  // from stepping through every reload.
+  function reloadPage(msg) {
+    if (!msg.cacheBust) {
+      window.location.reload();
+      return;
+    }
+    var next = new URL(window.location.href);
+    next.searchParams.set("_reload", Date.now());
+    window.location.replace(next.href);
+  }
+
+  // hardReload empties the origin's Cache API storage, which service workers
+  // commonly serve stale assets from, then reloads bypassing the HTTP cache
+  // where the browser supports it, or with a fresh query under -cache-bust.
+  function hardReload(msg) {
+    var done = function () {
+      if (msg.cacheBust) {
+        reloadPage(msg);
+      } else {
+        window.location.reload(true);
+      }
+    };
+    if (!window.caches) {
+      done();
+      return;
+    }
+    caches
+      .keys()
+      .then(function (keys) {
+        return Promise.all(
+          keys.map(function (key) {
+            return caches.delete(key);
+          })
+        );
+      })
+      .then(done, done);
+  }
+
+  // swapStylesheets re-fetches the stylesheet at path (relative to the watch
+  // directory) by giving its <link> a fresh cache-busting query, so the page
+  // keeps its scroll position and form state. If no link matches, e.g. for a
+  // partial pulled in with @import, every stylesheet is refreshed instead.
+  function swapStylesheets(path) {
+    var links = document.querySelectorAll('link[rel="stylesheet"][href]');
+    var matched = [];
+    for (var i = 0; i < links.length; i++) {
+      var pathname = new URL(links[i].href, window.location.href).pathname;
+      if (path && pathname.slice(-path.length - 1) === "/" + path) {
+        matched.push(links[i]);
+      }
+    }
+    if (matched.length === 0) {
+      matched = links;
+    }
+    for (var j = 0; j < matched.length; j++) {
+      var fresh = new URL(matched[j].href, window.location.href);
+      fresh.searchParams.set("refreshMeDaddy", Date.now());
+      matched[j].href = fresh.href;
+    }
+  }
+
+  // updateModule re-imports the JavaScript module at path (relative to the
+  // watch directory) under a cache-busting query and hands it to the page in
+  // a cancelable "refreshmedaddy:js-update" event on window. A listener that
+  // applies the new module calls preventDefault(); if none does, or the
+  // import fails, the page reloads as usual. The module's URL comes from a
+  // matching <script type="module"> if there is one, otherwise "/" + path.
+  function updateModule(path) {
+    var src = new URL("/" + path, window.location.href);
+    var modules = document.querySelectorAll('script[type="module"][src]');
+    for (var i = 0; i < modules.length; i++) {
+      var candidate = new URL(modules[i].src, window.location.href);
+      if (candidate.pathname.slice(-path.length - 1) === "/" + path) {
+        src = candidate;
+        break;
+      }
+    }
+    src.searchParams.set("refreshMeDaddy", Date.now());
+    import(src.href).then(
+      function (module) {
+        var event = new CustomEvent("refreshmedaddy:js-update", {
+          cancelable: true,
+          detail: { path: path, url: src.href, module: module },
+        });
+        if (window.dispatchEvent(event)) {
+          window.location.reload();
+        } else {
+          console.log("[RefreshMeDaddy] hot-updated " + path);
+        }
+      },
+      function (err) {
+        console.warn("[RefreshMeDaddy] could not re-import " + path + ", reloading", err);
+        window.location.reload();
+      }
+    );
+  }
+
+  // reportVisibility tells the server whether this tab is visible, so with
+  // -focused-only it can hold reloads for background tabs until they're shown
+  function reportVisibility(ws) {
+    if (ws.readyState === WebSocket.OPEN) {
+      ws.send(JSON.stringify({ type: "visibility", visible: document.visibilityState === "visible" }));
+    }
+  }
+
+  // query returns the query string for a connection: the last sequence seen,
+  // plus the auth token if there is one
+  function query() {
+    return "?since=" + seq + (token ? "&token=" + encodeURIComponent(token) : "");
+  }
+
+  // retry reconnects with exponential backoff so a stopped server isn't
+  // hammered, with jitter so a restart isn't met by every tab at once
+  function retry() {
+    setTimeout(connect, delay / 2 + Math.random() * (delay / 2));
+    delay = Math.min(delay * 2, maxDelay);
+  }
+
+  function connect() {
+    var opened = false;
+    var ws = new WebSocket(url + query());
+
+    ws.onopen = function () {
+      if (connectedBefore && reloadOnReconnect) {
+        console.log("[RefreshMeDaddy] reconnected, reloading");
+        window.location.reload();
+        return;
+      }
+      if (connectedBefore) {
+        console.log("[RefreshMeDaddy] reconnected to " + url);
+      }
+      opened = true;
+      connectedBefore = true;
+      delay = initialDelay;
+      if (paths) {
+        ws.send(JSON.stringify({ type: "subscribe", paths: paths.split(",") }));
+      }
+      reportVisibility(ws);
+    };
+
+    var onVisibilityChange = function () {
+      reportVisibility(ws);
+    };
+    document.addEventListener("visibilitychange", onVisibilityChange);
+
+    ws.onmessage = function (event) {
+      handle(parse(event.data));
+    };
+
+    ws.onclose = function (event) {
+      document.removeEventListener("visibilitychange", onVisibilityChange);
+      // The server says "bye" when it shuts down on purpose, e.g. to restart
+      if (event.code === 1001 && event.reason === "bye") {
+        console.log("[RefreshMeDaddy] server shut down, waiting for it to come back");
+      }
+      // A socket that never opened may have had its upgrade stripped by a
+      // proxy, so try long-polling before backing off
+      if (opened) {
+        retry();
+      } else {
+        poll();
+      }
+    };
+  }
+
+  // poll waits for the next reload over plain HTTP. The server answers 200
+  // with the reload message or 204 when the wait times out.
+  function poll() {
+    fetch(pollURL + query(), { cache: "no-store" })
+      .then(function (res) {
+        if (!res.ok) {
+          throw new Error("poll failed: " + res.status);
+        }
+        delay = initialDelay;
+        if (res.status === 200) {
+          return res.text().then(function (data) {
+            handle(parse(data));
+          });
+        }
+      })
+      .then(poll, retry);
+  }
+
+  connect();
+})();
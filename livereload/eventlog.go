@@ -0,0 +1,71 @@
+package livereload
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// eventLog appends one JSON line per reload broadcast to the -event-log file,
+// for analysing reload activity after a session. It is separate from the
+// operational log and only ever appended to.
+type eventLog struct {
+	mu  sync.Mutex    // Guards f
+	f   *os.File      // Open log file, nil once closed
+	enc *json.Encoder // Writes records to f
+}
+
+// eventRecord is a single line of the event log.
+type eventRecord struct {
+	Time      time.Time `json:"time"`           // When the reload was broadcast
+	Type      string    `json:"type"`           // Message kind, e.g. "reload" or "css"
+	Path      string    `json:"path,omitempty"` // Triggering path relative to its watch directory, empty for triggered reloads
+	Op        string    `json:"op,omitempty"`   // File operation of the triggering event
+	Coalesced int       `json:"coalesced"`      // File events collapsed into this reload, 0 for triggered reloads
+	Seq       uint64    `json:"seq"`            // Sequence number of the broadcast
+}
+
+// openEventLog opens path for appending, creating it if needed.
+func openEventLog(path string) (*eventLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &eventLog{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// record appends a line for the reload of the given kind and sequence number
+// caused by event after coalesced file events. Write errors are logged, never
+// returned, so a full disk can't stop reloads.
+func (l *eventLog) record(cfg *serverConfig, event fsnotify.Event, kind string, coalesced int, seq uint64) {
+	rec := eventRecord{Time: time.Now(), Type: kind, Coalesced: coalesced, Seq: seq}
+	if event.Name != "" {
+		_, rel := relPath(cfg, event.Name)
+		rec.Path = filepath.ToSlash(rel)
+		rec.Op = opName(event.Op)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return
+	}
+	if err := l.enc.Encode(rec); err != nil {
+		errorf("Failed to write event log: %v", err)
+	}
+}
+
+// Close closes the log file; later records are dropped.
+func (l *eventLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
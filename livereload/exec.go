@@ -0,0 +1,91 @@
+package livereload
+
+import (
+	"bytes"
+	"context"
+	"hash/fnv"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// runExec runs the -exec command for event through the system shell and
+// reports whether it succeeded. The command sees the changed path in
+// REFRESH_FILE and the operation in REFRESH_OP. Its output goes to the
+// server's own stdout and stderr; on failure stderr is logged with the error
+// instead, and the caller skips the reload.
+func runExec(ctx context.Context, cfg *serverConfig, event fsnotify.Event) bool {
+	cmd := shellCommand(ctx, cfg.Exec)
+	cmd.Env = append(os.Environ(), "REFRESH_FILE="+event.Name, "REFRESH_OP="+opName(event.Op))
+	var stderr bytes.Buffer
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = &stderr
+
+	start := time.Now()
+	debugPathf(cfg, event.Name, "Running %q for %s\n", cfg.Exec, event.Name)
+	if err := cmd.Run(); err != nil {
+		warnf("Command %q failed (%v), skipping reload:\n%s", cfg.Exec, err, stderr.Bytes())
+		return false
+	}
+	os.Stderr.Write(stderr.Bytes())
+	debugf(cfg, "Command %q finished in %s\n", cfg.Exec, time.Since(start).Round(time.Millisecond))
+	return true
+}
+
+// shellCommand returns a command running command through the system shell.
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "sh", "-c", command)
+}
+
+// watchCommand runs the -poll-cmd command every PollCmdInterval until ctx is
+// done and broadcasts a reload whenever a hash of its stdout differs from the
+// previous run's, e.g. for `git rev-parse HEAD` to reload on checkout. The
+// first successful run only records the baseline. A failing run is logged
+// and skipped, keeping the last good output to compare against.
+func watchCommand(ctx context.Context, cfg *serverConfig) {
+	var (
+		last uint64
+		seen bool
+	)
+	ticker := time.NewTicker(cfg.PollCmdInterval)
+	defer ticker.Stop()
+	for {
+		sum, ok := commandHash(ctx, cfg)
+		if ok {
+			if seen && sum != last {
+				debugf(cfg, "Output of %q changed, reloading\n", cfg.PollCmd)
+				broadcastReload(cfg, fsnotify.Event{}, "reload", nil, 0)
+			}
+			last, seen = sum, true
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// commandHash runs the -poll-cmd command and returns the FNV-1a hash of its
+// stdout, or false if it failed, in which case the failure is logged.
+func commandHash(ctx context.Context, cfg *serverConfig) (uint64, bool) {
+	cmd := shellCommand(ctx, cfg.PollCmd)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() == nil {
+			warnf("Command %q failed (%v), not reloading:\n%s", cfg.PollCmd, err, stderr.Bytes())
+		}
+		return 0, false
+	}
+	h := fnv.New64a()
+	h.Write(out)
+	return h.Sum64(), true
+}
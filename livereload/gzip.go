@@ -0,0 +1,138 @@
+package livereload
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// gzipMinSize is the smallest response worth compressing when its length is
+// known up front; gzip's header and trailer outweigh the savings below it.
+const gzipMinSize = 256
+
+// gzipPool recycles gzip writers, which are expensive to allocate.
+var gzipPool = sync.Pool{
+	New: func() any { return gzip.NewWriter(nil) },
+}
+
+// gzipHandler compresses next's responses with gzip for clients that accept
+// it. Responses that are already compressed, such as images, archives and
+// fonts, partial content and bodies shorter than gzipMinSize are passed
+// through unchanged.
+func gzipHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether r's Accept-Encoding lists gzip without ruling
+// it out with q=0.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		q := strings.TrimSpace(params)
+		if value, ok := strings.CutPrefix(q, "q="); ok {
+			if f, err := strconv.ParseFloat(value, 64); err == nil && f == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipWriter decides when the header is written whether to compress the
+// response, based on its status, type and length, and compresses the body if so.
+type gzipWriter struct {
+	http.ResponseWriter
+	gz    *gzip.Writer // Compressor, nil unless the response is compressed
+	wrote bool         // Whether the header has been written
+}
+
+// WriteHeader writes the header, switching it to a gzip encoding when the
+// response is worth compressing.
+func (g *gzipWriter) WriteHeader(status int) {
+	if g.wrote {
+		return
+	}
+	g.wrote = true
+	if status == http.StatusOK || status == http.StatusNotFound {
+		g.start()
+	}
+	g.ResponseWriter.WriteHeader(status)
+}
+
+// start sets up compression unless the response is already encoded,
+// precompressed, or known to be too short.
+func (g *gzipWriter) start() {
+	h := g.Header()
+	if h.Get("Content-Encoding") != "" || isCompressedType(h.Get("Content-Type")) {
+		return
+	}
+	if n, err := strconv.Atoi(h.Get("Content-Length")); err == nil && n < gzipMinSize {
+		return
+	}
+	// Byte ranges would refer to the uncompressed body
+	h.Del("Content-Length")
+	h.Del("Accept-Ranges")
+	h.Set("Content-Encoding", "gzip")
+	g.gz = gzipPool.Get().(*gzip.Writer)
+	g.gz.Reset(g.ResponseWriter)
+}
+
+// Write compresses p if the response is being compressed. A body written
+// without a Content-Type gets the sniffed one first, as net/http would.
+func (g *gzipWriter) Write(p []byte) (int, error) {
+	if !g.wrote {
+		if g.Header().Get("Content-Type") == "" {
+			g.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz == nil {
+		return g.ResponseWriter.Write(p)
+	}
+	return g.gz.Write(p)
+}
+
+// close flushes the compressed body and returns the compressor to the pool.
+func (g *gzipWriter) close() {
+	if g.gz == nil {
+		return
+	}
+	g.gz.Close()
+	gzipPool.Put(g.gz)
+	g.gz = nil
+}
+
+// isCompressedType reports whether content of the given MIME type is already
+// compressed, so gzipping it again would only cost CPU.
+func isCompressedType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	switch {
+	case mediaType == "image/svg+xml":
+		return false
+	case strings.HasPrefix(mediaType, "image/"), strings.HasPrefix(mediaType, "video/"),
+		strings.HasPrefix(mediaType, "audio/"), strings.HasPrefix(mediaType, "font/woff"):
+		return true
+	}
+	switch mediaType {
+	case "application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+		"application/x-bzip2", "application/x-xz", "application/x-7z-compressed", "application/pdf":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package livereload
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestGzipHandler(t *testing.T) {
+	body := strings.Repeat("<p>hello, reloaded world</p>\n", 100)
+	tests := []struct {
+		name        string
+		method      string
+		accept      string
+		contentType string
+		length      bool // Whether the handler sets Content-Length
+		body        string
+		gzipped     bool
+	}{
+		{"html", http.MethodGet, "gzip, deflate", "text/html; charset=utf-8", false, body, true},
+		{"html with length", http.MethodGet, "gzip", "text/html", true, body, true},
+		{"sniffed type", http.MethodGet, "gzip", "", false, body, true},
+		{"not accepted", http.MethodGet, "deflate, br", "text/html", false, body, false},
+		{"refused with q=0", http.MethodGet, "gzip;q=0", "text/html", false, body, false},
+		{"image", http.MethodGet, "gzip", "image/png", false, body, false},
+		{"archive", http.MethodGet, "gzip", "application/zip", false, body, false},
+		{"svg", http.MethodGet, "gzip", "image/svg+xml", false, body, true},
+		{"short", http.MethodGet, "gzip", "text/html", true, "<p>hi</p>", false},
+		{"head", http.MethodHead, "gzip", "text/html", true, body, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := gzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.contentType != "" {
+					w.Header().Set("Content-Type", tt.contentType)
+				}
+				if tt.length {
+					w.Header().Set("Content-Length", strconv.Itoa(len(tt.body)))
+				}
+				if r.Method != http.MethodHead {
+					io.WriteString(w, tt.body)
+				}
+			}))
+			req := httptest.NewRequest(tt.method, "/index.html", nil)
+			req.Header.Set("Accept-Encoding", tt.accept)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			resp := rec.Result()
+			if got := resp.Header.Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", got)
+			}
+			encoding := resp.Header.Get("Content-Encoding")
+			if !tt.gzipped {
+				if encoding != "" {
+					t.Fatalf("Content-Encoding = %q, want none", encoding)
+				}
+				if tt.method != http.MethodHead && rec.Body.String() != tt.body {
+					t.Errorf("body changed: got %d bytes, want %d", rec.Body.Len(), len(tt.body))
+				}
+				return
+			}
+			if encoding != "gzip" {
+				t.Fatalf("Content-Encoding = %q, want gzip", encoding)
+			}
+			if resp.Header.Get("Content-Length") != "" {
+				t.Errorf("Content-Length %q kept for a compressed body", resp.Header.Get("Content-Length"))
+			}
+			if rec.Body.Len() >= len(tt.body) {
+				t.Errorf("compressed body is %d bytes, no smaller than the %d-byte original", rec.Body.Len(), len(tt.body))
+			}
+			zr, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(zr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.body {
+				t.Errorf("decompressed body doesn't match: got %d bytes, want %d", len(got), len(tt.body))
+			}
+		})
+	}
+}
+
+func TestIsCompressedType(t *testing.T) {
+	tests := map[string]bool{
+		"image/png":                true,
+		"IMAGE/JPEG":               true,
+		"video/mp4":                true,
+		"font/woff2":               true,
+		"application/gzip":         true,
+		"application/pdf":          true,
+		"image/svg+xml":            false,
+		"text/html; charset=utf-8": false,
+		"application/javascript":   false,
+		"":                         false,
+	}
+	for contentType, want := range tests {
+		if got := isCompressedType(contentType); got != want {
+			t.Errorf("isCompressedType(%q) = %v, want %v", contentType, got, want)
+		}
+	}
+}
@@ -0,0 +1,463 @@
+package livereload
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// compressMinSize is the smallest message worth compressing; shorter ones,
+// like the plain "reload", come out larger under permessage-deflate.
+const compressMinSize = 128
+
+// client is a single connected WebSocket client.
+type client struct {
+	id       string             // Short random ID prefixed to the client's log lines
+	conn     *websocket.Conn    // Underlying WebSocket connection
+	cancel   context.CancelFunc // Stops the client's goroutines
+	send     chan []byte        // Messages waiting to be written by writePump
+	prefixes []string           // Subscribed path prefixes, nil for everything; owned by the hub
+	paused   bool               // Hold broadcasts until the client resumes; owned by the hub
+	hidden   bool               // The client reported its page hidden; owned by the hub
+	held     []byte             // Latest broadcast held while paused or hidden; owned by the hub
+	compress bool               // Compress messages of at least compressMinSize bytes
+}
+
+// newClient wraps conn under the given ID with room to queue queueSize
+// messages; cancel must stop the client's goroutines.
+func newClient(id string, conn *websocket.Conn, cancel context.CancelFunc, queueSize int) *client {
+	return &client{id: id, conn: conn, cancel: cancel, send: make(chan []byte, queueSize)}
+}
+
+// newConnID returns a short random ID for correlating a connection's log lines.
+func newConnID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// logf logs a message at level about the client, tagged with its ID.
+func (c *client) logf(level slog.Level, format string, args ...any) {
+	connLogf(level, c.id, format, args...)
+}
+
+// wants reports whether a broadcast touching paths should reach c: always for
+// unsubscribed clients or nil paths, otherwise when a path is under one of
+// c's prefixes.
+func (c *client) wants(paths []string) bool {
+	if c.prefixes == nil || paths == nil {
+		return true
+	}
+	for _, prefix := range c.prefixes {
+		for _, path := range paths {
+			if path == prefix || strings.HasPrefix(path, prefix+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writePump writes queued messages to the connection until ctx is done. Each
+// write gets its own deadline so a stalled client only ever blocks itself; a
+// failed write tears the connection down, which makes the read loop unregister it.
+func (c *client) writePump(ctx context.Context, timeout time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-c.send:
+			if timeout > 0 {
+				c.conn.SetWriteDeadline(time.Now().Add(timeout))
+			}
+			if c.compress {
+				c.conn.EnableWriteCompression(len(msg) >= compressMinSize)
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				c.logf(slog.LevelError, "Error sending reload message: %v", err)
+				c.cancel()
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// message is a broadcast and the changed paths that decide who receives it.
+type message struct {
+	data  []byte   // Payload written to clients
+	paths []string // Changed paths, nil to reach every client
+}
+
+// subscription replaces a client's path prefixes.
+type subscription struct {
+	c        *client  // Client to update
+	prefixes []string // New prefixes, nil for everything
+}
+
+// pauseRequest pauses or resumes broadcasts to a client.
+type pauseRequest struct {
+	c      *client // Client to update
+	paused bool    // Whether to hold broadcasts for c
+}
+
+// visibility records whether a client's page is visible.
+type visibility struct {
+	c      *client // Client to update
+	hidden bool    // Whether c's page is hidden
+}
+
+// Hub owns the set of connected clients and fans broadcasts out to them. The
+// set is only touched by the hub's run goroutine; everything else talks to it
+// over channels.
+type Hub struct {
+	register    chan *client      // Clients to add
+	unregister  chan *client      // Clients to remove
+	broadcast   chan message      // Messages to send to interested clients
+	subscribe   chan subscription // Subscription changes
+	pause       chan pauseRequest // Pause and resume requests
+	shown       chan visibility   // Page visibility reports
+	count       chan chan int     // Requests for the number of clients
+	reserve     chan chan bool    // Requests for a client slot
+	release     chan struct{}     // Slots given back by connections that never registered
+	quit        chan struct{}     // Closed to stop the hub
+	done        chan struct{}     // Closed once the run goroutine has exited
+	verbose     bool              // Enable verbose logging
+	focusedOnly bool              // Hold broadcasts for clients whose page is hidden
+	pollMu      sync.Mutex        // Guards reloaded, last and lastAt
+	reloaded    chan struct{}     // Closed and replaced on every broadcast to wake long-poll waiters
+	last        []byte            // Most recent broadcast message
+	lastAt      time.Time         // When last was broadcast
+	closeOnce   sync.Once         // Makes Close idempotent
+	maxClients  int               // Maximum number of clients, 0 for no limit
+	idleTimeout time.Duration     // How long the hub may go without clients before idle is closed, 0 for never
+	idle        chan struct{}     // Closed once the last client has been gone for idleTimeout
+	slots       int               // Reserved and registered slots, owned by run
+	clients     map[*client]bool  // Connected clients, owned by run
+}
+
+// newHub creates a hub allowing up to maxClients clients (0 for no limit) and
+// starts its run goroutine. With a positive idleTimeout, Idle is closed once
+// the last client has been gone that long. With focusedOnly, clients that
+// report their page hidden only get broadcasts once it is visible again.
+func newHub(verbose bool, maxClients int, idleTimeout time.Duration, focusedOnly bool) *Hub {
+	h := &Hub{
+		register:    make(chan *client),
+		unregister:  make(chan *client),
+		broadcast:   make(chan message),
+		subscribe:   make(chan subscription),
+		pause:       make(chan pauseRequest),
+		shown:       make(chan visibility),
+		count:       make(chan chan int),
+		reserve:     make(chan chan bool),
+		release:     make(chan struct{}),
+		quit:        make(chan struct{}),
+		done:        make(chan struct{}),
+		verbose:     verbose,
+		focusedOnly: focusedOnly,
+		maxClients:  maxClients,
+		idleTimeout: idleTimeout,
+		idle:        make(chan struct{}),
+		reloaded:    make(chan struct{}),
+		clients:     make(map[*client]bool),
+	}
+	go h.run()
+	return h
+}
+
+// run owns the client set and serves the hub's channels until Close is called.
+func (h *Hub) run() {
+	defer close(h.done)
+	// The idle timer runs while no clients are connected, from the moment the
+	// last one leaves until another connects
+	var (
+		idleTimer *time.Timer
+		idleC     <-chan time.Time
+		idled     bool // Whether idle has been closed
+	)
+	defer func() {
+		if idleTimer != nil {
+			idleTimer.Stop()
+		}
+	}()
+	for {
+		select {
+		case c := <-h.register:
+			h.clients[c] = true
+			if idleC != nil {
+				idleTimer.Stop()
+				idleC = nil
+			}
+		case c := <-h.unregister:
+			if h.clients[c] {
+				delete(h.clients, c)
+				h.slots--
+				if len(h.clients) == 0 && h.idleTimeout > 0 && !idled {
+					if h.verbose {
+						logAt(slog.LevelDebug, nil, "No clients connected, going idle in %s unless one connects", h.idleTimeout)
+					}
+					idleTimer = time.NewTimer(h.idleTimeout)
+					idleC = idleTimer.C
+				}
+			}
+		case sub := <-h.subscribe:
+			if h.clients[sub.c] {
+				sub.c.prefixes = sub.prefixes
+			}
+		case req := <-h.pause:
+			if !h.clients[req.c] {
+				break
+			}
+			req.c.paused = req.paused
+			h.catchUp(req.c)
+		case req := <-h.shown:
+			if !h.clients[req.c] {
+				break
+			}
+			req.c.hidden = req.hidden
+			h.catchUp(req.c)
+		case m := <-h.broadcast:
+			// Hand off to each client's writer so a slow client can't stall the hub
+			for c := range h.clients {
+				if !c.wants(m.paths) {
+					continue
+				}
+				if c.holding(h.focusedOnly) {
+					c.held = m.data
+					continue
+				}
+				h.deliver(c, m.data)
+			}
+			h.pollMu.Lock()
+			h.last = m.data
+			h.lastAt = time.Now()
+			close(h.reloaded)
+			h.reloaded = make(chan struct{})
+			h.pollMu.Unlock()
+		case reply := <-h.count:
+			reply <- len(h.clients)
+		case reply := <-h.reserve:
+			ok := h.maxClients <= 0 || h.slots < h.maxClients
+			if ok {
+				h.slots++
+			}
+			reply <- ok
+		case <-h.release:
+			h.slots--
+		case <-idleC:
+			idleC = nil
+			idled = true
+			close(h.idle)
+		case <-h.quit:
+			h.closeAll()
+			return
+		}
+	}
+}
+
+// closeReason is the reason in the close frame clients get on shutdown.
+const closeReason = "bye"
+
+// closeAll sends a going-away close frame with the reason "bye" to every
+// client, so it can tell the server left on purpose, and tears down its
+// connection. Hijacked WebSocket connections aren't tracked by http.Server,
+// so Shutdown alone would leave them to die abruptly.
+func (h *Hub) closeAll() {
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, closeReason)
+	for c := range h.clients {
+		if err := c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)); err != nil && h.verbose {
+			c.logf(slog.LevelDebug, "Error sending close message: %v", err)
+		}
+		c.cancel()
+		c.conn.Close()
+		delete(h.clients, c)
+	}
+}
+
+// Reserve claims a client slot ahead of a WebSocket upgrade. It reports false
+// if the hub is full or closed. A successful reservation must be followed by
+// Register, or by Release if the connection never gets that far.
+func (h *Hub) Reserve() bool {
+	reply := make(chan bool, 1)
+	select {
+	case h.reserve <- reply:
+		return <-reply
+	case <-h.done:
+		return false
+	}
+}
+
+// Release gives back a slot claimed by Reserve that was never registered.
+func (h *Hub) Release() {
+	select {
+	case h.release <- struct{}{}:
+	case <-h.done:
+	}
+}
+
+// Register adds c to the hub using a slot claimed by Reserve; Unregister frees
+// the slot again. It reports false if the hub has been closed.
+func (h *Hub) Register(c *client) bool {
+	select {
+	case h.register <- c:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+// Unregister removes c from the hub.
+func (h *Hub) Unregister(c *client) {
+	select {
+	case h.unregister <- c:
+	case <-h.done:
+	}
+}
+
+// holding reports whether broadcasts to c are held: while it is paused, or
+// with focusedOnly while its page is hidden.
+func (c *client) holding(focusedOnly bool) bool {
+	return c.paused || focusedOnly && c.hidden
+}
+
+// catchUp delivers the broadcast held for c once it is no longer holding, e.g.
+// after it resumes or its page becomes visible again.
+func (h *Hub) catchUp(c *client) {
+	if c.held != nil && !c.holding(h.focusedOnly) {
+		h.deliver(c, c.held)
+		c.held = nil
+	}
+}
+
+// deliver queues data for c without blocking. If c's queue is full the
+// oldest queued message is dropped to make room, since a client that is
+// behind only needs the latest reload. The run goroutine is the only sender
+// once c is registered, so the retry always finds room.
+func (h *Hub) deliver(c *client, data []byte) {
+	select {
+	case c.send <- data:
+		return
+	default:
+	}
+	select {
+	case <-c.send:
+		if h.verbose {
+			c.logf(slog.LevelDebug, "Client send queue full, dropping oldest message")
+		}
+	default: // The writer just took one
+	}
+	select {
+	case c.send <- data:
+	default:
+	}
+}
+
+// Broadcast sends data to every connected client interested in paths (see
+// client.wants) and wakes long-poll waiters, which have no subscriptions.
+// It only queues the message: each client's writePump writes it on its own
+// goroutine under its own deadline, so every client is written to at once and
+// the time to reach them doesn't grow with the number of clients.
+func (h *Hub) Broadcast(data []byte, paths []string) {
+	select {
+	case h.broadcast <- message{data: data, paths: paths}:
+	case <-h.done:
+	}
+}
+
+// Subscribe limits c to broadcasts touching one of prefixes, which are
+// normalized to slash-separated paths without leading or trailing slashes.
+// An empty list, or one containing the root, subscribes c to everything.
+func (h *Hub) Subscribe(c *client, prefixes []string) {
+	var clean []string
+	for _, prefix := range prefixes {
+		prefix = strings.Trim(path.Clean("/"+filepath.ToSlash(prefix)), "/")
+		if prefix == "" {
+			clean = nil
+			break
+		}
+		clean = append(clean, prefix)
+	}
+	select {
+	case h.subscribe <- subscription{c: c, prefixes: clean}:
+	case <-h.done:
+	}
+}
+
+// Pause holds broadcasts to c until it is resumed, at which point the latest
+// one it missed is delivered.
+func (h *Hub) Pause(c *client, paused bool) {
+	select {
+	case h.pause <- pauseRequest{c: c, paused: paused}:
+	case <-h.done:
+	}
+}
+
+// SetHidden records whether c's page is hidden. With focusedOnly, broadcasts
+// are held while it is, and the latest one is delivered once it is visible.
+func (h *Hub) SetHidden(c *client, hidden bool) {
+	select {
+	case h.shown <- visibility{c: c, hidden: hidden}:
+	case <-h.done:
+	}
+}
+
+// Count returns the number of connected clients.
+func (h *Hub) Count() int {
+	reply := make(chan int, 1)
+	select {
+	case h.count <- reply:
+		return <-reply
+	case <-h.done:
+		return 0
+	}
+}
+
+// Wait blocks until the next broadcast and returns its message. It reports
+// false if ctx is done or the hub is closed first.
+func (h *Hub) Wait(ctx context.Context) ([]byte, bool) {
+	h.pollMu.Lock()
+	reloaded := h.reloaded
+	h.pollMu.Unlock()
+
+	select {
+	case <-reloaded:
+		h.pollMu.Lock()
+		defer h.pollMu.Unlock()
+		return h.last, true
+	case <-ctx.Done():
+		return nil, false
+	case <-h.done:
+		return nil, false
+	}
+}
+
+// Idle returns a channel that is closed once the last client has been gone
+// for the hub's idle timeout. Without one it is never closed.
+func (h *Hub) Idle() <-chan struct{} {
+	return h.idle
+}
+
+// Recent returns the most recent broadcast if it went out within window, or
+// nil if there was none that recent.
+func (h *Hub) Recent(window time.Duration) []byte {
+	h.pollMu.Lock()
+	defer h.pollMu.Unlock()
+	if h.last == nil || time.Since(h.lastAt) > window {
+		return nil
+	}
+	return h.last
+}
+
+// Close disconnects every client and stops the hub. It is safe to call more than once.
+func (h *Hub) Close() {
+	h.closeOnce.Do(func() { close(h.quit) })
+	<-h.done
+}
@@ -0,0 +1,176 @@
+package livereload
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// registerTestClients registers n clients without connections on h, each
+// with a one-message queue, and unregisters them when the test ends so Close
+// doesn't try to send them close frames.
+func registerTestClients(tb testing.TB, h *Hub, n int) []*client {
+	tb.Helper()
+	clients := make([]*client, n)
+	for i := range clients {
+		if !h.Reserve() {
+			tb.Fatalf("Reserve refused client %d", i)
+		}
+		clients[i] = newClient(fmt.Sprint(i), nil, func() {}, 1)
+		h.Register(clients[i])
+	}
+	tb.Cleanup(func() {
+		for _, c := range clients {
+			h.Unregister(c)
+		}
+		h.Close()
+	})
+	return clients
+}
+
+func BenchmarkBroadcast(b *testing.B) {
+	msg := []byte("reload")
+	for _, n := range []int{1, 100, 1000, 10000} {
+		b.Run(fmt.Sprintf("clients=%d", n), func(b *testing.B) {
+			h := newHub(false, 0, 0, false)
+			registerTestClients(b, h, n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				h.Broadcast(msg, nil)
+			}
+			// Broadcast returns once the hub has the message; Count waits
+			// for the last fan-out to finish
+			h.Count()
+		})
+	}
+}
+
+func TestBroadcastReachesEveryClient(t *testing.T) {
+	h := newHub(false, 0, 0, false)
+	clients := registerTestClients(t, h, 100)
+	h.Broadcast([]byte("reload"), nil)
+	h.Count()
+	for _, c := range clients {
+		select {
+		case msg := <-c.send:
+			if string(msg) != "reload" {
+				t.Fatalf("client %s got %q, want %q", c.id, msg, "reload")
+			}
+		default:
+			t.Fatalf("client %s got nothing", c.id)
+		}
+	}
+}
+
+// TestConcurrentClients connects and disconnects many real clients while file
+// events keep firing; run it with -race.
+func TestConcurrentClients(t *testing.T) {
+	srv := runTestServer(t, Config{})
+	dir := testWatchDir(srv)
+	stop := make(chan struct{})
+	var writers sync.WaitGroup
+	writers.Add(1)
+	go func() {
+		defer writers.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			case <-time.After(2 * time.Millisecond):
+			}
+			os.WriteFile(filepath.Join(dir, fmt.Sprintf("f%d.js", i%8)), []byte{byte(i)}, 0o644)
+		}
+	}()
+
+	const clients = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := dialEndpoint(srv, srv.cfg.Path)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			// Every client must see reloads while others come and go
+			conn.SetReadDeadline(time.Now().Add(testTimeout))
+			for n := 0; n < 3; n++ {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	writers.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	waitFor(t, "clients to unregister", func() bool { return srv.cfg.hub.Count() == 0 })
+}
+
+// TestStalledClient checks that a client that stops reading is dropped once
+// a write to it times out, while broadcasts keep reaching everyone else.
+func TestStalledClient(t *testing.T) {
+	srv := runTestServer(t, Config{NoWatch: true, WriteTimeout: 100 * time.Millisecond})
+	hub := srv.cfg.hub
+	healthy := dialTestServer(t, srv)
+	stalled, err := dialEndpoint(srv, srv.cfg.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	waitFor(t, "both clients to register", func() bool { return hub.Count() == 2 })
+
+	received := make(chan []byte, 64)
+	go func() {
+		for {
+			_, data, err := healthy.ReadMessage()
+			if err != nil {
+				return
+			}
+			received <- data
+		}
+	}()
+
+	// Large messages fill the socket buffers of the client that never reads,
+	// so a write to it blocks until the write timeout
+	big := make([]byte, 1<<20)
+	deadline := time.Now().Add(testTimeout)
+	for hub.Count() == 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("stalled client still registered after %s of broadcasts", testTimeout)
+		}
+		start := time.Now()
+		hub.Broadcast(big, nil)
+		if d := time.Since(start); d > time.Second {
+			t.Fatalf("Broadcast blocked for %s behind the stalled client", d)
+		}
+		select {
+		case <-received:
+		case <-time.After(testTimeout):
+			t.Fatal("healthy client stopped receiving broadcasts")
+		}
+	}
+
+	hub.Broadcast([]byte("reload"), nil)
+	for {
+		select {
+		case data := <-received:
+			if string(data) == "reload" {
+				return
+			}
+		case <-time.After(testTimeout):
+			t.Fatal("healthy client didn't get the broadcast after the stalled one was dropped")
+		}
+	}
+}
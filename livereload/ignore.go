@@ -0,0 +1,347 @@
+package livereload
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// shouldIgnore checks if a path should be ignored based on the server configuration.
+// Each ignore entry is compared as an exact path and matched as a glob against both
+// the base name and the path relative to its watch directory, so "node_modules"
+// matches nested copies and "*.tmp" matches any temp file. A trailing "/**"
+// matches everything beneath that prefix. isDir tells directory-only gitignore
+// patterns whether they apply.
+func shouldIgnore(cfg *serverConfig, path string, isDir bool) bool {
+	return ignoreReason(cfg, path, isDir) != ""
+}
+
+// ignoreReason explains why shouldIgnore would ignore path, or returns "" if it wouldn't.
+func ignoreReason(cfg *serverConfig, path string, isDir bool) string {
+	base := filepath.Base(path)
+	root, rel := relPath(cfg, path)
+	if !onlyAllows(cfg, rel, isDir) {
+		return "not matched by -only"
+	}
+	if cfg.SkipHidden && isHidden(rel) {
+		return "hidden path, -skip-hidden is set"
+	}
+	if !cfg.NoDefaultIgnores && !isDir {
+		for _, pattern := range defaultIgnores {
+			if ok, _ := filepath.Match(pattern, base); ok {
+				return fmt.Sprintf("matches default ignore %q", pattern)
+			}
+		}
+	}
+	for _, ignore := range cfg.Ignore {
+		if ignore == "" {
+			continue
+		}
+		if ignore == path || filepath.Clean(ignore) == filepath.Clean(path) || matchPattern(ignore, base, rel) {
+			return fmt.Sprintf("matches ignore entry %q", ignore)
+		}
+	}
+	if applyRules(cfg.ignoreFileRules[filepath.Clean(root)], filepath.ToSlash(rel), isDir, false) {
+		return "matches " + ignoreFilePath(cfg, root)
+	}
+	if cfg.gitignore != nil && gitignored(cfg, root, filepath.ToSlash(rel), isDir) {
+		return "matches .gitignore"
+	}
+	return ""
+}
+
+// onlyAllows reports whether rel, a path relative to its watch root, passes
+// the -only allowlist: when the path or one of its parent directories
+// matches an entry, or, for a directory, when entries could match something
+// beneath it. Without -only every path passes.
+func onlyAllows(cfg *serverConfig, rel string, isDir bool) bool {
+	if len(cfg.Only) == 0 {
+		return true
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == "." {
+		return true
+	}
+	for p := rel; p != "."; p = path.Dir(p) {
+		for _, pattern := range cfg.Only {
+			if pattern != "" && matchPattern(pattern, path.Base(p), p) {
+				return true
+			}
+		}
+	}
+	if isDir {
+		for _, pattern := range cfg.Only {
+			if pattern != "" && mayContainMatch(path.Clean(filepath.ToSlash(pattern)), rel) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mayContainMatch reports whether pattern could match a path beneath the
+// directory dir. A pattern without a slash matches base names, which can
+// turn up anywhere; otherwise dir must match the pattern's leading segments.
+func mayContainMatch(pattern, dir string) bool {
+	patterns := strings.Split(pattern, "/")
+	if len(patterns) == 1 {
+		return true
+	}
+	for i, name := range strings.Split(dir, "/") {
+		if i >= len(patterns)-1 {
+			return false
+		}
+		if patterns[i] == "**" {
+			return true
+		}
+		if ok, _ := path.Match(patterns[i], name); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// defaultIgnores are base-name patterns for the swap, backup and temp files
+// editors write next to the files being edited. They apply to files only.
+var defaultIgnores = []string{
+	"*~",    // Backups from Emacs and many others
+	".#*",   // Emacs lock files
+	"#*#",   // Emacs auto-save files
+	"*.swp", // Vim swap files
+	"*.swo", // Vim swap files when the .swp exists
+	"*.swx", // Vim swap files on some systems
+	"4913",  // Vim probe file written to check directory permissions
+	"*.tmp", // Temporary files from atomic saves
+}
+
+// isHidden reports whether any component of rel, a path relative to its watch
+// root, starts with a dot. The root itself is never hidden, so -watch . or a
+// root inside a dot-directory still works.
+func isHidden(rel string) bool {
+	for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+		if strings.HasPrefix(part, ".") && part != "." && part != ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern reports whether pattern matches either the base name or the
+// relative path. Both are compared with forward slashes, so an ignore list
+// written with "/" works on Windows too, where rel uses backslashes.
+func matchPattern(pattern, base, rel string) bool {
+	pattern = path.Clean(filepath.ToSlash(pattern))
+	rel = filepath.ToSlash(rel)
+	if prefix, ok := strings.CutSuffix(pattern, "/**"); ok {
+		return rel == prefix || strings.HasPrefix(rel, prefix+"/")
+	}
+	if ok, _ := path.Match(pattern, base); ok {
+		return true
+	}
+	ok, _ := path.Match(pattern, rel)
+	return ok
+}
+
+// hasWatchedExt reports whether path has one of the -ext extensions, ignoring
+// case. An empty list accepts every path. Entries may omit the leading dot.
+func hasWatchedExt(cfg *serverConfig, path string) bool {
+	if len(cfg.Extensions) == 0 {
+		return true
+	}
+	ext := filepath.Ext(path)
+	for _, want := range cfg.Extensions {
+		if want != "" && strings.EqualFold(ext, "."+strings.TrimPrefix(want, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// ignoreRule is a single pattern from a gitignore-style file.
+type ignoreRule struct {
+	pattern  string // Slash-separated glob with the "!" and trailing "/" stripped
+	negate   bool   // Pattern started with "!" and re-includes matching paths
+	dirOnly  bool   // Pattern ended with "/" and only matches directories
+	anchored bool   // Pattern contains a slash and matches the path relative to its file
+}
+
+// parseIgnoreFile reads gitignore-style rules from path. Blank lines and
+// lines starting with "#" are skipped; a leading backslash escapes "#" or "!".
+func parseIgnoreFile(path string) ([]ignoreRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var rule ignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else {
+			line = strings.TrimPrefix(line, `\`)
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			rule.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		rule.pattern = line
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// match reports whether rel, relative to the directory of the rule's file, matches the rule.
+func (r ignoreRule) match(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.anchored {
+		return matchGlob(r.pattern, rel)
+	}
+	return matchGlob(r.pattern, path.Base(rel))
+}
+
+// applyRules runs rules against rel in order, starting from the ignored state
+// passed in. As in gitignore, the last matching rule wins.
+func applyRules(rules []ignoreRule, rel string, isDir, ignored bool) bool {
+	if rel == "." {
+		return ignored
+	}
+	for _, rule := range rules {
+		if rule.match(rel, isDir) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// refreshIgnoreName is the ignore file read from each watch root by default.
+const refreshIgnoreName = ".refreshignore"
+
+// loadIgnoreFiles reads the ignore file for each watch root into
+// cfg.ignoreFileRules: the -ignore-file if given, otherwise the root's
+// .refreshignore. Patterns are relative to the watch root either way. A
+// missing .refreshignore is fine; a missing -ignore-file is an error.
+func loadIgnoreFiles(cfg *serverConfig) error {
+	rules := make(map[string][]ignoreRule)
+	for _, root := range cfg.WatchDirs {
+		if isFileRoot(cfg, root) {
+			continue // Nothing beneath a single file to ignore
+		}
+		path := ignoreFilePath(cfg, root)
+		parsed, err := parseIgnoreFile(path)
+		if os.IsNotExist(err) && cfg.IgnoreFile == "" {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("reading ignore file: %w", err)
+		}
+		rules[filepath.Clean(root)] = parsed
+	}
+	cfg.ignoreFileRules = rules
+	return nil
+}
+
+// ignoreFilePath returns the ignore file that applies to root.
+func ignoreFilePath(cfg *serverConfig, root string) string {
+	if cfg.IgnoreFile != "" {
+		return cfg.IgnoreFile
+	}
+	return filepath.Join(root, refreshIgnoreName)
+}
+
+// isIgnoreFile reports whether path is one of the ignore files in use.
+func isIgnoreFile(cfg *serverConfig, path string) bool {
+	for _, root := range cfg.WatchDirs {
+		if filepath.Clean(path) == filepath.Clean(ignoreFilePath(cfg, root)) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadGitignore parses the .gitignore in dir, if any, and stores its rules keyed by dir.
+func loadGitignore(cfg *serverConfig, dir string) error {
+	rules, err := parseIgnoreFile(filepath.Join(dir, ".gitignore"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	cfg.gitignoreMu.Lock()
+	cfg.gitignore[filepath.Clean(dir)] = rules
+	cfg.gitignoreMu.Unlock()
+	return nil
+}
+
+// gitignored applies the loaded .gitignore rules to rel, a slash-separated path
+// relative to the watch directory root. Files are consulted from the root down
+// and the last matching rule wins, so nested files and negations override their
+// parents. The .git directory itself is always ignored.
+func gitignored(cfg *serverConfig, root, rel string, isDir bool) bool {
+	if rel == "." {
+		return false
+	}
+	if rel == ".git" || strings.HasPrefix(rel, ".git/") {
+		return true
+	}
+	cfg.gitignoreMu.RLock()
+	defer cfg.gitignoreMu.RUnlock()
+	ignored := false
+	dir, sub := filepath.Clean(root), rel
+	for {
+		ignored = applyRules(cfg.gitignore[dir], sub, isDir, ignored)
+		next, rest, found := strings.Cut(sub, "/")
+		if !found {
+			return ignored
+		}
+		dir, sub = filepath.Join(dir, next), rest
+	}
+}
+
+// matchGlob matches a slash-separated name against a glob pattern in which a
+// "**" segment matches any number of path segments.
+func matchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+// matchSegments matches name segments against pattern segments.
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
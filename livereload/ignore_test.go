@@ -0,0 +1,136 @@
+package livereload
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestMatchPattern(t *testing.T) {
+	// rel is built with the OS separator, as relPath returns it; patterns are
+	// written with forward slashes, native separators or a mix of both
+	native := filepath.FromSlash
+	tests := []struct {
+		pattern, rel string
+		want         bool
+	}{
+		{"*.tmp", native("src/a.tmp"), true},
+		{"node_modules", native("web/node_modules"), true},
+		{"src/*.js", native("src/app.js"), true},
+		{native("src/*.js"), native("src/app.js"), true},
+		{"src/*.js", native("lib/app.js"), false},
+		{"src/*.js", native("src/lib/app.js"), false},
+		{"src/vendor/**", native("src/vendor/a/b.js"), true},
+		{native("src/vendor") + "/**", native("src/vendor/a/b.js"), true},
+		{"src/vendor/**", native("src/vendor"), true},
+		{"src/vendor/**", native("src/vendored/b.js"), false},
+		{"./src//lib/", native("src/lib"), true},
+		{filepath.Join("src", "lib") + "/*.css", native("src/lib/site.css"), true},
+	}
+	for _, tt := range tests {
+		if got := matchPattern(tt.pattern, filepath.Base(tt.rel), tt.rel); got != tt.want {
+			t.Errorf("matchPattern(%q, %q) = %v, want %v", tt.pattern, tt.rel, got, tt.want)
+		}
+	}
+}
+
+func TestShouldIgnore(t *testing.T) {
+	root := filepath.FromSlash("/project")
+	cfg := &serverConfig{Config: Config{
+		WatchDirs: []string{root},
+		Ignore:    []string{"node_modules", "*.log", "build/**", filepath.Join(root, "secret.txt")},
+	}}
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		// Base-name matches
+		{"node_modules", true, true},
+		{"debug.log", false, true},
+		// Nested matches
+		{"web/node_modules", true, true},
+		{"web/logs/server.log", false, true},
+		{"build/js/app.js", false, true},
+		{"build", true, true},
+		// Exact paths
+		{"secret.txt", false, true},
+		// Non-matches
+		{"src/app.js", false, false},
+		{"node_modules_old", true, false},
+		{"debug.log.js", false, false},
+		{"web/build/app.js", false, false},
+		{"src/secret.txt", false, false},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(root, filepath.FromSlash(tt.path))
+		if got := shouldIgnore(cfg, path, tt.isDir); got != tt.want {
+			t.Errorf("shouldIgnore(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestHasWatchedExt(t *testing.T) {
+	cfg := &serverConfig{Config: Config{Extensions: []string{"js", ".CSS", "html"}}}
+	tests := map[string]bool{
+		"app.js":          true,
+		"APP.JS":          true,
+		"styles/site.css": true,
+		"site.Css":        true,
+		"index.html":      true,
+		"index.htm":       false,
+		"app.jsx":         false,
+		"app.ts":          false,
+		"Makefile":        false,
+		"js":              false,
+	}
+	for path, want := range tests {
+		if got := hasWatchedExt(cfg, path); got != want {
+			t.Errorf("hasWatchedExt(%q) = %v, want %v", path, got, want)
+		}
+	}
+	if !hasWatchedExt(&serverConfig{}, "anything.bin") {
+		t.Error("an empty extension list rejected a path")
+	}
+}
+
+func TestParseIgnoreFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".refreshignore")
+	writeFile(t, path, "# build output\n"+
+		"\n"+
+		"dist/\n"+
+		"   \n"+
+		"\t# indented comments are patterns, as in gitignore\n"+
+		"*.log  \r\n"+
+		"!keep.log\n"+
+		`\#notes.md`+"\n"+
+		"/docs/api\n"+
+		"#\n")
+	got, err := parseIgnoreFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ignoreRule{
+		{pattern: "dist", dirOnly: true},
+		{pattern: "\t# indented comments are patterns, as in gitignore"},
+		{pattern: "*.log"},
+		{pattern: "keep.log", negate: true},
+		{pattern: "#notes.md"},
+		{pattern: "docs/api", anchored: true},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got rules\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestParseIgnoreFileOnlyComments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".refreshignore")
+	writeFile(t, path, "# nothing ignored yet\n\n#*.tmp\n")
+	rules, err := parseIgnoreFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 0 {
+		t.Errorf("got rules %+v, want none", rules)
+	}
+}
@@ -0,0 +1,89 @@
+package livereload
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+)
+
+// jsonLogger receives every log line as a structured record once
+// UseJSONLogging has been called; until then lines go to the log package as
+// plain text.
+var jsonLogger atomic.Pointer[slog.Logger]
+
+// UseJSONLogging switches all logging, the package's and the standard
+// logger's, to one JSON object per line on w, for log aggregators. Each
+// record has time, level and msg fields, plus conn_id for lines about a
+// WebSocket connection and path for lines about a file or request. Lines
+// still written through the log package, such as net/http's, are logged at
+// the info level.
+func UseJSONLogging(w io.Writer) {
+	l := slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	jsonLogger.Store(l)
+	slog.SetDefault(l)
+}
+
+// logAt logs a message at level. With JSON logging attrs become fields of
+// the record; the plain-text line is the formatted message alone.
+func logAt(level slog.Level, attrs []slog.Attr, format string, args ...any) {
+	l := jsonLogger.Load()
+	if l == nil {
+		log.Printf(format, args...)
+		return
+	}
+	l.LogAttrs(context.Background(), level, strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"), attrs...)
+}
+
+// pathAttr returns the path field for a line about a file or request.
+func pathAttr(path string) []slog.Attr {
+	return []slog.Attr{slog.String("path", path)}
+}
+
+// connLogf logs a message about the WebSocket connection with the given ID,
+// prefixed with the ID in plain text and as the conn_id field in JSON.
+func connLogf(level slog.Level, id, format string, args ...any) {
+	if jsonLogger.Load() == nil {
+		log.Printf("[%s] "+format, append([]any{id}, args...)...)
+		return
+	}
+	logAt(level, []slog.Attr{slog.String("conn_id", id)}, format, args...)
+}
+
+// debugf logs a message only useful when investigating, such as every file
+// event, if verbose logging is enabled.
+func debugf(cfg *serverConfig, format string, args ...any) {
+	if cfg.Verbose {
+		logAt(slog.LevelDebug, nil, format, args...)
+	}
+}
+
+// debugPathf is debugf for a line about the file or directory at path,
+// which JSON logging records as the path field.
+func debugPathf(cfg *serverConfig, path, format string, args ...any) {
+	if cfg.Verbose {
+		logAt(slog.LevelDebug, pathAttr(path), format, args...)
+	}
+}
+
+// infof logs an informational message, such as the startup banner, unless
+// the log level is "error". Errors and warnings are always logged.
+func infof(cfg *serverConfig, format string, args ...any) {
+	if cfg.LogLevel != "error" {
+		logAt(slog.LevelInfo, nil, format, args...)
+	}
+}
+
+// warnf logs a problem the server carries on from, such as a rejected
+// connection or a directory it can't watch.
+func warnf(format string, args ...any) {
+	logAt(slog.LevelWarn, nil, format, args...)
+}
+
+// errorf logs a failure, such as a watcher or server error.
+func errorf(format string, args ...any) {
+	logAt(slog.LevelError, nil, format, args...)
+}
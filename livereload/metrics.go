@@ -0,0 +1,27 @@
+package livereload
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// serveMetrics writes server counters in the Prometheus text exposition
+// format, one sample per endpoint labelled with its path.
+func serveMetrics(cfgs []*serverConfig, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetric(w, "refreshmedaddy_reloads_total", "counter", "Reload broadcasts sent to clients.", cfgs,
+		func(c *serverConfig) uint64 { return c.reloads.Load() })
+	writeMetric(w, "refreshmedaddy_file_events_total", "counter", "File system events received from the watcher.", cfgs,
+		func(c *serverConfig) uint64 { return c.fileEvents.Load() })
+	writeMetric(w, "refreshmedaddy_connected_clients", "gauge", "Currently connected WebSocket clients.", cfgs,
+		func(c *serverConfig) uint64 { return uint64(c.hub.Count()) })
+}
+
+// writeMetric writes a metric's HELP and TYPE lines, then its value for each
+// endpoint in cfgs.
+func writeMetric(w http.ResponseWriter, name, kind, help string, cfgs []*serverConfig, value func(*serverConfig) uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, c := range cfgs {
+		fmt.Fprintf(w, "%s{path=%q} %d\n", name, c.Path, value(c))
+	}
+}
@@ -0,0 +1,165 @@
+package livereload
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// pollWatcher is a stat-based stand-in for fsnotify.Watcher, for filesystems
+// that don't deliver native events such as some Docker bind mounts and NFS
+// shares. Like fsnotify it watches individual directories rather than trees,
+// so addDir's recursion and new-directory handling work unchanged.
+type pollWatcher struct {
+	Events    chan fsnotify.Event             // Detected changes
+	Errors    chan error                      // Errors reading watched directories
+	interval  time.Duration                   // Time between scans
+	mu        sync.Mutex                      // Guards dirs
+	dirs      map[string]map[string]fileState // Watched directories and the last seen state of their entries
+	quit      chan struct{}                   // Closed to stop polling
+	closeOnce sync.Once                       // Makes Close idempotent
+}
+
+// fileState is the part of a file's metadata compared between scans.
+type fileState struct {
+	modTime time.Time
+	size    int64
+	isDir   bool
+}
+
+// newPollWatcher creates a poller that scans its directories every interval.
+func newPollWatcher(interval time.Duration) *pollWatcher {
+	p := &pollWatcher{
+		Events:   make(chan fsnotify.Event),
+		Errors:   make(chan error),
+		interval: interval,
+		dirs:     make(map[string]map[string]fileState),
+		quit:     make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Add starts watching dir, recording its current contents as the baseline.
+func (p *pollWatcher) Add(dir string) error {
+	entries, err := scanDir(dir)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.dirs[filepath.Clean(dir)] = entries
+	p.mu.Unlock()
+	return nil
+}
+
+// Remove stops watching dir.
+func (p *pollWatcher) Remove(dir string) error {
+	p.mu.Lock()
+	delete(p.dirs, filepath.Clean(dir))
+	p.mu.Unlock()
+	return nil
+}
+
+// Close stops polling; Events and Errors are closed once the poller exits.
+func (p *pollWatcher) Close() error {
+	p.closeOnce.Do(func() { close(p.quit) })
+	return nil
+}
+
+// run scans on every tick and delivers the resulting events.
+func (p *pollWatcher) run() {
+	defer close(p.Events)
+	defer close(p.Errors)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.quit:
+			return
+		case <-ticker.C:
+			// Events are sent without holding mu so the consumer can call Add
+			events, errs := p.scan()
+			for _, err := range errs {
+				select {
+				case p.Errors <- err:
+				case <-p.quit:
+					return
+				}
+			}
+			for _, event := range events {
+				select {
+				case p.Events <- event:
+				case <-p.quit:
+					return
+				}
+			}
+		}
+	}
+}
+
+// scan diffs every watched directory against its last snapshot. Directories
+// that no longer exist are dropped; their removal is reported by the parent,
+// or as a Remove of the directory itself when the parent isn't watched.
+func (p *pollWatcher) scan() ([]fsnotify.Event, []error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var (
+		events []fsnotify.Event
+		errs   []error
+	)
+	for dir, before := range p.dirs {
+		after, err := scanDir(dir)
+		if os.IsNotExist(err) {
+			delete(p.dirs, dir)
+			if _, ok := p.dirs[filepath.Dir(dir)]; !ok {
+				events = append(events, fsnotify.Event{Name: dir, Op: fsnotify.Remove})
+			}
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for path, state := range after {
+			old, ok := before[path]
+			switch {
+			case !ok:
+				events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Create})
+			case !state.isDir && (!state.modTime.Equal(old.modTime) || state.size != old.size):
+				events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Write})
+			}
+		}
+		for path := range before {
+			if _, ok := after[path]; !ok {
+				events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Remove})
+			}
+		}
+		p.dirs[dir] = after
+	}
+	return events, errs
+}
+
+// scanDir stats every entry in dir.
+func scanDir(dir string) (map[string]fileState, error) {
+	contents, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]fileState, len(contents))
+	for _, d := range contents {
+		info, err := d.Info()
+		if err != nil {
+			continue // Removed between ReadDir and Info
+		}
+		entries[filepath.Join(dir, d.Name())] = fileState{
+			modTime: info.ModTime(),
+			size:    info.Size(),
+			isDir:   d.IsDir(),
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,63 @@
+package livereload
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// probePrefix starts the name of every file created by -self-test.
+const probePrefix = "refreshmedaddy-selftest-"
+
+// isProbe reports whether path is a file created by -self-test.
+func isProbe(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), probePrefix)
+}
+
+// runSelfTest creates a probe file in each watch root and checks that the
+// watcher reports it within timeout. Probe events are routed to cfg.probes
+// instead of triggering reloads. Each probe is removed before returning,
+// whether or not its event arrived.
+func runSelfTest(cfg *serverConfig, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for !cfg.watching.Load() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("watcher did not start within %s", timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, root := range cfg.WatchDirs {
+		if err := probeDir(cfg, rootDir(cfg, root), timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// probeDir creates a probe file in dir and waits for the watcher to report it.
+// The file is kept until then so a polling watcher gets a chance to see it.
+func probeDir(cfg *serverConfig, dir string, timeout time.Duration) error {
+	f, err := os.CreateTemp(dir, probePrefix+"*")
+	if err != nil {
+		return fmt.Errorf("creating probe file in %s: %w", dir, err)
+	}
+	name := f.Name()
+	defer os.Remove(name)
+	f.WriteString("probe\n")
+	f.Close()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case got := <-cfg.probes:
+			if filepath.Clean(got) == filepath.Clean(name) {
+				return nil
+			}
+		case <-timer.C:
+			return fmt.Errorf("no event for %s within %s; file events may not work on this filesystem, try -poll", name, timeout)
+		}
+	}
+}
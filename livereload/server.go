@@ -0,0 +1,1392 @@
+// Package livereload implements the RefreshMeDaddy live-reload server: it
+// watches directories for changes and tells connected browsers to reload over
+// WebSockets, with a long-poll fallback. The refreshMeDaddy command is a thin
+// CLI around it; other Go programs can embed it with New and Start. The
+// package leaves signal handling to its caller.
+package livereload
+
+import (
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/gorilla/websocket"
+)
+
+// Defaults applied by New to empty Config fields.
+const (
+	DefaultPort            = "8080"
+	DefaultPath            = "/refreshMeDaddy"
+	DefaultPollInterval    = 500 * time.Millisecond
+	DefaultPollCmdInterval = 2 * time.Second
+	DefaultBufferSize      = 1024
+	DefaultQueueSize       = 8
+	DefaultMaxMessageSize  = 4096
+	DefaultReloadMessage   = "reload"
+)
+
+// maxBufferSize bounds the WebSocket read and write buffers.
+const maxBufferSize = 1 << 20
+
+// longPollTimeout is how long a poll request waits for a reload before returning empty.
+const longPollTimeout = 25 * time.Second
+
+// Config configures a Server. The zero value is usable: it serves on
+// DefaultPort, watches the current directory and reloads on every change.
+// Durations left at zero disable the feature they control.
+type Config struct {
+	Host               string        // Host or IP address to listen on, empty for all interfaces
+	Port               string        // Port on which the server listens, DefaultPort if empty
+	Network            string        // Listen network: "tcp" (dual-stack), "tcp4" or "tcp6"; "tcp" if empty
+	Path               string        // URL path of the WebSocket endpoint, DefaultPath if empty
+	BasePath           string        // Prefix for every route, for serving behind a reverse proxy under a subdirectory
+	WatchDirs          []string      // Directories or single files to watch for changes, "." if empty
+	WatchFiles         []string      // Extra files to watch anywhere on disk, exempt from the ignore and extension filters
+	Mounts             []Mount       // Further endpoints, each reloading its own clients for its own watch directories
+	NoWatch            bool          // Don't watch or even look at the file system; reloads only come from triggers, PollCmd and Reload
+	Verbose            bool          // Enable verbose logging
+	LogLevel           string        // "error", "info" or "debug"; "info" if empty, "debug" if Verbose is set
+	Ignore             []string      // Paths and glob patterns to ignore
+	Only               []string      // If set, only paths matching one of these patterns are watched
+	IgnoreFile         string        // Ignore file to use instead of each root's .refreshignore
+	Extensions         []string      // File extensions that trigger a reload, empty allows all
+	WatchOps           []string      // File operations that trigger reloads; all but chmod if empty
+	AllowedOrigins     []string      // Origins allowed to connect, empty allows all
+	Debounce           time.Duration // Quiet window before broadcasting a reload
+	DebounceMax        time.Duration // Upper bound on how long a reload can be deferred
+	MinReloadInterval  time.Duration // Minimum time between reloads
+	StartupGrace       time.Duration // Hold reloads for this long after starting, then send one if anything changed
+	Poll               bool          // Use the stat-based poller instead of fsnotify
+	PollInterval       time.Duration // Time between scans when polling, DefaultPollInterval if zero
+	ServeDir           string        // Directory to serve static files from, if any
+	NotFoundOverlay    bool          // Answer missing static files with a page that reloads once they appear
+	TLSCert            string        // TLS certificate file
+	TLSKey             string        // TLS private key file
+	PingInterval       time.Duration // Interval between keepalive pings
+	WriteTimeout       time.Duration // Deadline for each write to a client
+	HTTPReadTimeout    time.Duration // Time limit for reading a plain HTTP request, 0 for none
+	HTTPWriteTimeout   time.Duration // Time limit for writing a plain HTTP response, 0 for none
+	HTTPIdleTimeout    time.Duration // How long an idle keep-alive connection stays open, 0 for HTTPReadTimeout
+	ReadBufferSize     int           // WebSocket read buffer in bytes, DefaultBufferSize if zero
+	WriteBufferSize    int           // WebSocket write buffer in bytes, DefaultBufferSize if zero
+	Compress           bool          // Negotiate permessage-deflate with clients that support it
+	MaxMessageSize     int64         // Largest message accepted from a WebSocket client in bytes, DefaultMaxMessageSize if zero
+	Gzip               bool          // Gzip the client script and static files for clients that accept it
+	MaxClients         int           // Maximum number of WebSocket clients, 0 for no limit
+	QueueSize          int           // Messages queued per WebSocket client before the oldest is dropped, DefaultQueueSize if zero
+	IdleTimeout        time.Duration // Report idle once the last client has been gone this long, 0 to disable
+	MaxWatches         int           // Maximum number of watched directories, 0 for no limit
+	MaxDepth           int           // Directory levels watched per root, counting the root as 1; 0 for unlimited
+	FollowSymlinks     bool          // Watch directories reached through symlinks
+	Strict             bool          // Fail instead of skipping subdirectories that can't be read
+	JSONMessages       bool          // Send reloadMessage JSON instead of plain text
+	ReloadMessage      string        // Plain-text reload message, DefaultReloadMessage if empty
+	AppendPath         bool          // Append the changed path to plain-text messages
+	HotCSS             bool          // Swap changed stylesheets instead of reloading, implies JSONMessages
+	HMRDirs            []string      // Directories, relative to the watch root, whose JavaScript modules are hot-swapped, implies JSONMessages
+	HardReload         bool          // Make every reload a hard reload that clears the page's caches
+	CacheBust          bool          // Have clients reload to the page URL with a fresh _reload query parameter, implies JSONMessages
+	HardReloadPatterns []string      // Patterns of files whose changes trigger a hard reload
+	Handshake          bool          // Send a "connected" message when a WebSocket opens
+	NoReconnectReload  bool          // Don't have the bundled client reload the page when it reconnects after losing the server
+	FocusedOnly        bool          // Only reload clients whose page is visible; hidden ones catch up when shown
+	RecentReloadWindow time.Duration // Send new clients a reload broadcast this recently, 0 to disable
+	DryRun             bool          // Log reload decisions without broadcasting
+	Exec               string        // Shell command to run before each reload, which is skipped if it fails
+	PollCmd            string        // Shell command whose output is checked for changes, reloading when it does
+	PollCmdInterval    time.Duration // Time between runs of PollCmd, DefaultPollCmdInterval if zero
+	HashCheck          bool          // Only reload when a file's content hash changes
+	TriggerToken       string        // Token required by the trigger endpoint, empty allows anyone
+	AuthToken          string        // Token clients must present to connect, empty allows anyone
+	DenyUserAgent      string        // Regular expression of User-Agents whose WebSocket upgrades are refused, empty allows all
+	EventLog           string        // File to append a JSON line to for every reload, empty for none
+	UseGitignore       bool          // Merge .gitignore patterns into the ignore rules
+	SkipHidden         bool          // Skip paths with a component starting with a dot
+	NoDefaultIgnores   bool          // Don't skip editor swap, backup and temp files
+}
+
+// endpointSuffixes are appended to an endpoint's path to form its routes.
+var endpointSuffixes = []string{"", ".js", "/poll", "/sse", "/trigger", "/pause", "/resume"}
+
+// Mount is an additional endpoint with its own clients, which are reloaded
+// for changes under its own watch directories only. Every other setting is
+// shared with the Config it belongs to.
+type Mount struct {
+	Path      string   // URL path of the endpoint, e.g. /reload/docs
+	WatchDirs []string // Directories or single files whose changes reload its clients
+}
+
+// Validate reports the first problem with c that would stop a Server from
+// starting, without touching the filesystem.
+func (c Config) Validate() error {
+	if c.Path != "" && (!strings.HasPrefix(c.Path, "/") || c.Path == "/") {
+		return fmt.Errorf("invalid path %q: it must start with / and name an endpoint, e.g. %s", c.Path, DefaultPath)
+	}
+	// Every endpoint's routes must be distinct from the others' and the server's own
+	routes := map[string]bool{"/healthz": true, "/metrics": true}
+	claim := func(endpoint string) error {
+		endpoint = strings.TrimSuffix(endpoint, "/")
+		for _, suffix := range endpointSuffixes {
+			if routes[endpoint+suffix] {
+				return fmt.Errorf("endpoint path %s clashes with another route", endpoint)
+			}
+		}
+		for _, suffix := range endpointSuffixes {
+			routes[endpoint+suffix] = true
+		}
+		return nil
+	}
+	if err := claim(cmp.Or(c.Path, DefaultPath)); err != nil {
+		return err
+	}
+	for _, m := range c.Mounts {
+		if !strings.HasPrefix(m.Path, "/") || m.Path == "/" {
+			return fmt.Errorf("invalid mount path %q: it must start with / and name an endpoint, e.g. /reload/docs", m.Path)
+		}
+		if len(m.WatchDirs) == 0 {
+			return fmt.Errorf("mount %s has no directories to watch", m.Path)
+		}
+		if err := claim(m.Path); err != nil {
+			return err
+		}
+	}
+	switch c.LogLevel {
+	case "", "error", "info", "debug":
+	default:
+		return fmt.Errorf("invalid log level %q: it must be error, info or debug", c.LogLevel)
+	}
+	if c.NoWatch && (len(c.WatchFiles) > 0 || len(c.Mounts) > 0) {
+		return fmt.Errorf("watch files and mounts need a watcher, which -no-watch turns off")
+	}
+	switch c.Network {
+	case "", "tcp", "tcp4", "tcp6":
+	default:
+		return fmt.Errorf("invalid network %q: it must be tcp, tcp4 or tcp6", c.Network)
+	}
+	for _, size := range []int{c.ReadBufferSize, c.WriteBufferSize} {
+		if size < 0 || size > maxBufferSize {
+			return fmt.Errorf("invalid buffer size %d: it must be between 0 and %d bytes", size, maxBufferSize)
+		}
+	}
+	if c.QueueSize < 0 {
+		return fmt.Errorf("invalid queue size %d: it must not be negative", c.QueueSize)
+	}
+	if c.MaxMessageSize < 0 {
+		return fmt.Errorf("invalid maximum message size %d: it must not be negative", c.MaxMessageSize)
+	}
+	if _, err := parseOps(c.WatchOps); err != nil {
+		return err
+	}
+	if _, err := regexp.Compile(c.DenyUserAgent); err != nil {
+		return fmt.Errorf("invalid user agent deny pattern %q: %w", c.DenyUserAgent, err)
+	}
+	// TLS needs both halves of the key pair
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return fmt.Errorf("both a TLS certificate and key must be set to enable TLS")
+	}
+	return nil
+}
+
+// serverConfig is a Config plus the state shared by the server's goroutines.
+type serverConfig struct {
+	Config
+	gitignore       map[string][]ignoreRule // Parsed .gitignore rules keyed by directory
+	gitignoreMu     sync.RWMutex            // Guards gitignore, which the initial walk fills concurrently
+	fileRoots       map[string]bool         // Cleaned -watch and -watch-file entries naming a single file rather than a directory
+	watchFiles      map[string]bool         // Cleaned -watch-file entries
+	ignoreFileRules map[string][]ignoreRule // Parsed ignore file rules keyed by watch root
+	upgrader        websocket.Upgrader      // Upgrader for websocket connections
+	hub             *Hub                    // Connected clients and broadcasts
+	started         time.Time               // When the server started, for uptime reporting
+	watching        atomic.Bool             // Whether the file watcher is running
+	reloads         atomic.Uint64           // Reload broadcasts sent
+	lastReload      atomic.Int64            // When the last reload was broadcast, in Unix nanoseconds; 0 before the first
+	fileEvents      atomic.Uint64           // File events received from the watcher
+	seq             atomic.Uint64           // Sequence number of the last reload broadcast
+	paused          atomic.Bool             // Whether reloads are paused for every client
+	missed          atomic.Bool             // Whether a reload was held back while paused
+	probes          chan string             // Names of self-test probe files seen by the watcher
+	events          *eventLog               // Machine-readable reload log, nil without EventLog
+	ops             fsnotify.Op             // Operations that trigger reloads, parsed from WatchOps
+	denyUserAgent   *regexp.Regexp          // Compiled DenyUserAgent, nil to allow every client
+}
+
+// Server is a live-reload server. Create one with New, then call Start.
+type Server struct {
+	cfg    serverConfig                // Configuration and shared state
+	mounts []*serverConfig             // One per Config.Mounts entry, with its own clients and watcher
+	idle   <-chan struct{}             // Closed once every endpoint's clients have been gone for IdleTimeout
+	server *http.Server                // HTTP server, set by Start
+	cancel context.CancelFunc          // Stops the watcher, set by Start
+	addr   net.Addr                    // Address the listener is bound to, set by Start
+	connMu sync.Mutex                  // Guards conns
+	conns  map[net.Conn]http.ConnState // Open HTTP connections not yet hijacked
+}
+
+// New creates a server for config, filling in defaults for empty fields.
+// Nothing is watched or served until Start is called.
+func New(config Config) *Server {
+	if config.Port == "" {
+		config.Port = DefaultPort
+	}
+	if config.Path == "" {
+		config.Path = DefaultPath
+	}
+	if config.Network == "" {
+		config.Network = "tcp"
+	}
+	// Verbose is the older spelling of the debug level
+	if config.Verbose {
+		config.LogLevel = "debug"
+	}
+	if config.LogLevel == "" {
+		config.LogLevel = "info"
+	}
+	config.Verbose = config.LogLevel == "debug"
+	// Accept IPv6 hosts with or without brackets; JoinHostPort adds them back
+	config.Host = strings.TrimSuffix(strings.TrimPrefix(config.Host, "["), "]")
+	config.Path = strings.TrimSuffix(config.Path, "/")
+	// "dev", "/dev/" and "/dev" all mean /dev; "/" means no prefix
+	if config.BasePath != "" {
+		config.BasePath = strings.TrimSuffix(path.Clean("/"+config.BasePath), "/")
+	}
+	if len(config.WatchDirs) == 0 {
+		config.WatchDirs = []string{"."}
+	}
+	// Extra files are watched as single-file roots; copy so the caller's
+	// slice is never appended to
+	config.WatchDirs = append(slices.Clip(config.WatchDirs), config.WatchFiles...)
+	if config.PollInterval <= 0 {
+		config.PollInterval = DefaultPollInterval
+	}
+	if config.PollCmdInterval <= 0 {
+		config.PollCmdInterval = DefaultPollCmdInterval
+	}
+	if config.ReloadMessage == "" {
+		config.ReloadMessage = DefaultReloadMessage
+	}
+	if config.ReadBufferSize <= 0 {
+		config.ReadBufferSize = DefaultBufferSize
+	}
+	if config.WriteBufferSize <= 0 {
+		config.WriteBufferSize = DefaultBufferSize
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = DefaultQueueSize
+	}
+	if config.MaxMessageSize <= 0 {
+		config.MaxMessageSize = DefaultMaxMessageSize
+	}
+	// Stylesheet and module swaps need the message type only JSON messages
+	// carry, and cache busting its cacheBust field
+	if config.HotCSS || len(config.HMRDirs) > 0 || config.CacheBust {
+		config.JSONMessages = true
+	}
+
+	s := &Server{}
+	initConfig(&s.cfg, config)
+	s.idle = s.cfg.hub.Idle()
+	for _, m := range config.Mounts {
+		sub := config
+		sub.Path = strings.TrimSuffix(m.Path, "/")
+		sub.WatchDirs = m.WatchDirs
+		// Extra files, the command poller and the static file server belong
+		// to the main endpoint
+		sub.WatchFiles, sub.PollCmd, sub.ServeDir, sub.Mounts = nil, "", "", nil
+		mc := &serverConfig{}
+		initConfig(mc, sub)
+		s.mounts = append(s.mounts, mc)
+	}
+	if len(s.mounts) > 0 && config.IdleTimeout > 0 {
+		idle := make(chan struct{})
+		go func() {
+			for _, cfg := range s.configs() {
+				<-cfg.hub.Idle()
+			}
+			close(idle)
+		}()
+		s.idle = idle
+	}
+	return s
+}
+
+// initConfig fills in cfg's shared state for config, whose defaults New has
+// already applied, and starts its hub.
+func initConfig(cfg *serverConfig, config Config) {
+	cfg.Config = config
+	cfg.hub = newHub(cfg.Verbose, cfg.MaxClients, cfg.IdleTimeout, cfg.FocusedOnly)
+	cfg.probes = make(chan string, 1)
+	cfg.ops, _ = parseOps(cfg.WatchOps)
+	if cfg.DenyUserAgent != "" {
+		cfg.denyUserAgent, _ = regexp.Compile(cfg.DenyUserAgent)
+	}
+	if cfg.UseGitignore {
+		cfg.gitignore = make(map[string][]ignoreRule)
+	}
+	cfg.upgrader = websocket.Upgrader{
+		ReadBufferSize:  cfg.ReadBufferSize,
+		WriteBufferSize: cfg.WriteBufferSize,
+		// Only takes effect for clients that offer permessage-deflate
+		EnableCompression: cfg.Compress,
+		// CheckOrigin verifies the origin of the request
+		CheckOrigin: func(r *http.Request) bool {
+			return checkOrigin(cfg, r)
+		},
+	}
+}
+
+// configs returns the main endpoint's configuration followed by each mount's.
+func (s *Server) configs() []*serverConfig {
+	return append([]*serverConfig{&s.cfg}, s.mounts...)
+}
+
+// Start validates the configuration, starts watching and begins serving in
+// the background. It returns once the server is listening and watching, or
+// only listening with NoWatch, or the error that prevented either; the
+// watcher stops when ctx is done or Shutdown is called. Connections are
+// accepted while the initial watches are still being added.
+func (s *Server) Start(ctx context.Context) error {
+	cfg := &s.cfg
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	// With NoWatch nothing on disk is looked at, not even the watch roots
+	for _, c := range s.configs() {
+		if c.NoWatch {
+			continue
+		}
+		if err := prepareWatch(c); err != nil {
+			return err
+		}
+	}
+	if cfg.EventLog != "" {
+		events, err := openEventLog(cfg.EventLog)
+		if err != nil {
+			return fmt.Errorf("opening event log: %w", err)
+		}
+		for _, c := range s.configs() {
+			c.events = events
+		}
+	}
+
+	s.conns = make(map[net.Conn]http.ConnState)
+	// The HTTP timeouts only cover plain requests: the WebSocket upgrade
+	// clears them from the connection, and long-poll and SSE responses extend
+	// their own write deadline
+	s.server = &http.Server{
+		Handler:      accessLog(cfg, s.handler()),
+		ConnState:    s.trackConn,
+		ReadTimeout:  cfg.HTTPReadTimeout,
+		WriteTimeout: cfg.HTTPWriteTimeout,
+		IdleTimeout:  cfg.HTTPIdleTimeout,
+	}
+	if cfg.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			s.closeEventLog()
+			return fmt.Errorf("loading TLS key pair: %w", err)
+		}
+		s.server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	ln, err := net.Listen(cfg.Network, net.JoinHostPort(cfg.Host, cfg.Port))
+	if err != nil {
+		s.closeEventLog()
+		return err
+	}
+	s.addr = ln.Addr()
+	// Set before serving, since /healthz reads it from request goroutines
+	for _, c := range s.configs() {
+		c.started = time.Now()
+	}
+
+	ctx, s.cancel = context.WithCancel(ctx)
+
+	// Server startup logs
+	if cfg.Verbose {
+		logAt(slog.LevelDebug, nil, "Verbose logging enabled\n")
+	}
+	if cfg.NoWatch {
+		infof(cfg, "Not watching files, reloads only come from %s%s/trigger\n", cfg.BasePath, cfg.Path)
+	}
+	if cfg.Verbose && !cfg.NoWatch {
+		logAt(slog.LevelDebug, nil, "Watching %q for %s, debounce %s (at most %s), ignoring %q, only %q, extensions %q\n",
+			cfg.WatchDirs, opNames(cfg.ops), cfg.Debounce, cfg.DebounceMax, cfg.Ignore, cfg.Only, cfg.Extensions)
+	}
+	if cfg.Verbose {
+		logAt(slog.LevelDebug, nil, "Endpoint %s%s, JSON messages %t, hot CSS %t, handshake %t, focused only %t, max clients %d\n",
+			cfg.BasePath, cfg.Path, cfg.JSONMessages, cfg.HotCSS, cfg.Handshake, cfg.FocusedOnly, cfg.MaxClients)
+	}
+	for _, m := range s.mounts {
+		infof(m, "Endpoint %s%s reloads for changes in %q\n", m.BasePath, m.Path, m.WatchDirs)
+	}
+	if cfg.TLSCert != "" {
+		infof(cfg, "Starting live-reload server with TLS on %s\n", ln.Addr())
+		ln = tls.NewListener(ln, s.server.TLSConfig)
+	} else {
+		infof(cfg, "Starting live-reload server on %s\n", ln.Addr())
+	}
+	// Serve while the initial watches are still being added, so pages opened
+	// during a long walk of a large tree can already connect
+	go func() {
+		if err := s.server.Serve(ln); err != http.ErrServerClosed {
+			errorf("Server error: %v", err)
+		}
+	}()
+
+	// Start watching files in separate goroutines, one per endpoint, failing
+	// the start if the initial watches can't be set up
+	if err := s.startWatching(ctx); err != nil {
+		s.cancel()
+		s.server.Close()
+		for _, c := range s.configs() {
+			c.hub.Close()
+		}
+		s.closeEventLog()
+		return err
+	}
+	if cfg.PollCmd != "" {
+		go watchCommand(ctx, cfg)
+	}
+	return nil
+}
+
+// startWatching starts a watcher for every endpoint and waits until each has
+// added its initial watches, returning the first error. With NoWatch nothing
+// is watched.
+func (s *Server) startWatching(ctx context.Context) error {
+	if s.cfg.NoWatch {
+		return nil
+	}
+	ready := make(chan error, len(s.mounts)+1)
+	for _, c := range s.configs() {
+		go watchFiles(c, ctx, ready)
+	}
+	var startErr error
+	for range s.configs() {
+		if err := <-ready; err != nil && startErr == nil {
+			startErr = err
+		}
+	}
+	return startErr
+}
+
+// prepareWatch checks cfg's watch roots and -watch-file entries before
+// anything is watched, recording which name single files, and loads their
+// ignore files.
+func prepareWatch(cfg *serverConfig) error {
+	cfg.fileRoots = make(map[string]bool)
+	cfg.watchFiles = make(map[string]bool)
+	for _, file := range cfg.WatchFiles {
+		info, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("invalid -watch-file: %w", err)
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("invalid -watch-file: %q is not a regular file; use -watch for directories", file)
+		}
+		cfg.watchFiles[filepath.Clean(file)] = true
+	}
+	for _, dir := range cfg.WatchDirs {
+		isFile, err := checkWatchDir(dir)
+		if err != nil {
+			return fmt.Errorf("invalid watch directory: %w", err)
+		}
+		if isFile {
+			cfg.fileRoots[filepath.Clean(dir)] = true
+		}
+	}
+	return loadIgnoreFiles(cfg)
+}
+
+// Addr returns the address the server is listening on, or nil before Start
+// has succeeded. With Port "0" this is how the chosen port is found, e.g. to
+// run a server per test in parallel.
+func (s *Server) Addr() net.Addr {
+	return s.addr
+}
+
+// routes registers the server's endpoints on a new mux: the main endpoint's
+// and each mount's, then the server-wide ones.
+func (s *Server) routes() *http.ServeMux {
+	cfg := &s.cfg
+	mux := http.NewServeMux()
+	for _, c := range s.configs() {
+		s.endpointRoutes(mux, c)
+	}
+	// Health probe
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		serveHealth(s.configs(), w, r)
+	})
+	// Prometheus metrics
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		serveMetrics(s.configs(), w, r)
+	})
+	// Optional static file server with client script injection
+	if cfg.ServeDir != "" {
+		mux.Handle("/", s.compressed(newInjectHandler(cfg.ServeDir, scriptURL(cfg), cfg.NotFoundOverlay)))
+		infof(cfg, "Serving static files from %s\n", cfg.ServeDir)
+	}
+	return mux
+}
+
+// endpointRoutes registers the routes under cfg.Path on mux, which reach
+// cfg's clients only.
+func (s *Server) endpointRoutes(mux *http.ServeMux, cfg *serverConfig) {
+	// WebSocket handler
+	mux.HandleFunc(cfg.Path, func(w http.ResponseWriter, r *http.Request) {
+		serveWs(cfg, w, r)
+	})
+	// Long-poll fallback for clients that can't use WebSockets
+	mux.HandleFunc(cfg.Path+"/poll", func(w http.ResponseWriter, r *http.Request) {
+		servePoll(cfg, w, r)
+	})
+	// Server-Sent Events for clients that would rather use EventSource
+	mux.HandleFunc(cfg.Path+"/sse", func(w http.ResponseWriter, r *http.Request) {
+		serveSSE(cfg, w, r)
+	})
+	// Manual reloads for build pipelines
+	mux.HandleFunc(cfg.Path+"/trigger", func(w http.ResponseWriter, r *http.Request) {
+		serveTrigger(cfg, w, r)
+	})
+	// Pausing and resuming reloads for every client
+	mux.HandleFunc(cfg.Path+"/pause", func(w http.ResponseWriter, r *http.Request) {
+		servePause(cfg, w, r, true)
+	})
+	mux.HandleFunc(cfg.Path+"/resume", func(w http.ResponseWriter, r *http.Request) {
+		servePause(cfg, w, r, false)
+	})
+	// Embedded client script
+	mux.Handle(cfg.Path+".js", s.compressed(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveClientJS(cfg, w, r)
+	})))
+}
+
+// compressed wraps next with gzipHandler when Config.Gzip is set.
+func (s *Server) compressed(next http.Handler) http.Handler {
+	if !s.cfg.Gzip {
+		return next
+	}
+	return gzipHandler(next)
+}
+
+// handler returns the server's routes, mounted under -base-path when one is
+// set. The prefix is stripped before routing, so a reverse proxy can forward
+// /dev/... unchanged.
+func (s *Server) handler() http.Handler {
+	mux := s.routes()
+	if s.cfg.BasePath == "" {
+		return mux
+	}
+	outer := http.NewServeMux()
+	outer.Handle(s.cfg.BasePath+"/", http.StripPrefix(s.cfg.BasePath, mux))
+	return outer
+}
+
+// Idle returns a channel that is closed once every client has disconnected
+// and none has come back within Config.IdleTimeout, for callers that want to
+// shut the server down then. With mounts, each endpoint's clients must have
+// gone idle. It is never closed without an idle timeout.
+func (s *Server) Idle() <-chan struct{} {
+	return s.idle
+}
+
+// Shutdown disconnects every client, stops the watcher and gracefully shuts
+// down the HTTP server, waiting for requests in flight until ctx is done.
+// Connections still open at that point are logged and force-closed, and the
+// context's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	for _, c := range s.configs() {
+		c.hub.Close()
+	}
+	if s.server == nil {
+		return nil // Never started
+	}
+	s.cancel()
+	err := s.server.Shutdown(ctx)
+	if ctx.Err() != nil {
+		s.connMu.Lock()
+		for conn, state := range s.conns {
+			warnf("Force-closing %s connection from %s", state, conn.RemoteAddr())
+		}
+		s.connMu.Unlock()
+		s.server.Close()
+	}
+	s.closeEventLog()
+	return err
+}
+
+// closeEventLog closes the -event-log file, if one is open.
+func (s *Server) closeEventLog() {
+	if s.cfg.events != nil {
+		if err := s.cfg.events.Close(); err != nil {
+			errorf("Failed to close event log: %v", err)
+		}
+	}
+}
+
+// trackConn records open HTTP connections so Shutdown can report the ones it
+// has to force-close. Hijacked connections belong to WebSocket clients, which
+// the hub closes itself.
+func (s *Server) trackConn(conn net.Conn, state http.ConnState) {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	switch state {
+	case http.StateHijacked, http.StateClosed:
+		delete(s.conns, conn)
+	default:
+		s.conns[conn] = state
+	}
+}
+
+// Reload tells every connected client, on every endpoint, to reload right
+// away, bypassing the watcher, debouncing and rate limiting.
+func (s *Server) Reload() {
+	for _, c := range s.configs() {
+		broadcastReload(c, fsnotify.Event{}, "reload", nil, 0)
+	}
+}
+
+// Pause stops reloads from reaching any client until Resume is called. File
+// events are still watched and logged in the meantime.
+func (s *Server) Pause() {
+	for _, c := range s.configs() {
+		pauseReloads(c)
+	}
+}
+
+// Resume lets reloads through again after Pause. With catchUp, one reload is
+// sent right away to each endpoint that held one back while paused.
+func (s *Server) Resume(catchUp bool) {
+	for _, c := range s.configs() {
+		resumeReloads(c, catchUp)
+	}
+}
+
+// SelfTest checks that the watcher reports a change in every watch directory
+// within timeout, the main endpoint's and each mount's; see runSelfTest. The
+// server must have been started. With NoWatch there is no watcher to check,
+// so it fails straight away.
+func (s *Server) SelfTest(timeout time.Duration) error {
+	if s.cfg.NoWatch {
+		return errors.New("nothing is watched with -no-watch")
+	}
+	for _, c := range s.configs() {
+		if err := runSelfTest(c, timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Snippet returns a ready-to-paste script tag connecting to the server.
+func (s *Server) Snippet() string {
+	return snippet(&s.cfg)
+}
+
+// accessLog wraps next to log every request's method, path, remote address,
+// origin and user agent when verbose logging is enabled.
+func accessLog(cfg *serverConfig, next http.Handler) http.Handler {
+	if !cfg.Verbose {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logAt(slog.LevelDebug, pathAttr(r.URL.Path), "%s %s from %s (origin %q, user agent %q)", r.Method, r.URL.Path, r.RemoteAddr, r.Header.Get("Origin"), r.UserAgent())
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveWs handles incoming WebSocket connections.
+func serveWs(cfg *serverConfig, w http.ResponseWriter, r *http.Request) {
+	// Someone opening the endpoint in a browser gets directions, not an error
+	if !websocket.IsWebSocketUpgrade(r) {
+		serveEndpointInfo(cfg, w, r)
+		return
+	}
+	// Turned away quietly, since the point is to keep probes out of the log
+	if cfg.denyUserAgent != nil && cfg.denyUserAgent.MatchString(r.UserAgent()) {
+		debugf(cfg, "Rejecting WebSocket connection from %s: user agent %q is denied", r.RemoteAddr, r.UserAgent())
+		http.Error(w, "user agent not allowed", http.StatusForbidden)
+		return
+	}
+	ok, protocol := checkAuthToken(cfg, r)
+	if !ok {
+		warnf("Rejecting WebSocket connection from %s: missing or invalid auth token", r.RemoteAddr)
+		http.Error(w, "missing or invalid auth token", http.StatusUnauthorized)
+		return
+	}
+	id := newConnID()
+	// Claim a slot before upgrading so a full server can still answer over plain HTTP
+	if !cfg.hub.Reserve() {
+		connLogf(slog.LevelWarn, id, "Rejecting WebSocket connection from %s: client limit of %d reached", r.RemoteAddr, cfg.MaxClients)
+		http.Error(w, fmt.Sprintf("too many clients connected (limit %d)", cfg.MaxClients), http.StatusServiceUnavailable)
+		return
+	}
+	// Upgrade HTTP server connection to a WebSocket connection
+	// A browser only accepts the upgrade if we pick the subprotocol it offered
+	var header http.Header
+	if protocol != "" {
+		header = http.Header{"Sec-Websocket-Protocol": {protocol}}
+	}
+	conn, err := cfg.upgrader.Upgrade(w, r, header)
+	if err != nil {
+		cfg.hub.Release()
+		connLogf(slog.LevelWarn, id, "WebSocket upgrade error from %s: %v", r.RemoteAddr, err)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := newClient(id, conn, cancel, cfg.QueueSize)
+	if cfg.Verbose {
+		c.logf(slog.LevelDebug, "WebSocket connection established from %s (origin %q, user agent %q)", r.RemoteAddr, r.Header.Get("Origin"), r.UserAgent())
+	}
+	c.compress = cfg.Compress
+	go c.writePump(ctx, cfg.WriteTimeout)
+	// Confirm the connection, then queue a catch-up reload, both ahead of
+	// anything the hub sends. The writer is already draining the queue, so
+	// these can't block on a small -queue-size.
+	if cfg.Handshake {
+		c.send <- handshakePayload(cfg)
+	}
+	if msg := missedReload(cfg, r); msg != nil {
+		c.send <- msg
+	} else if msg := recentReload(cfg, r); msg != nil {
+		if cfg.Verbose {
+			c.logf(slog.LevelDebug, "Sending reload broadcast within the last %s", cfg.RecentReloadWindow)
+		}
+		c.send <- msg
+	}
+	if !cfg.hub.Register(c) {
+		cancel()
+		conn.Close()
+		return
+	}
+
+	// Clients only send short JSON commands; anything bigger is cut off with a
+	// 1009 (message too big) close frame by the read loop below
+	conn.SetReadLimit(cfg.MaxMessageSize)
+
+	// Keepalive: a client that stops answering pings hits the read deadline
+	// and gets cleaned up by the read loop below
+	if cfg.PingInterval > 0 {
+		pongWait := 2 * cfg.PingInterval
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(pongWait))
+		})
+		go pingClient(cfg, ctx, c)
+	}
+
+	// Listen for messages on the WebSocket connection
+	go func() {
+		defer func() {
+			conn.Close()
+			cfg.hub.Unregister(c)
+			cancel()
+			if cfg.Verbose {
+				c.logf(slog.LevelDebug, "WebSocket connection from %s closed", r.RemoteAddr)
+			}
+		}()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+				kind, data, err := conn.ReadMessage()
+				if errors.Is(err, websocket.ErrReadLimit) {
+					c.logf(slog.LevelWarn, "Closing WebSocket connection from %s: message larger than %d bytes", r.RemoteAddr, cfg.MaxMessageSize)
+					return
+				}
+				if err != nil {
+					if cfg.Verbose {
+						c.logf(slog.LevelDebug, "WebSocket read error: %v", err)
+					}
+					return
+				}
+				if kind == websocket.BinaryMessage {
+					c.logf(slog.LevelWarn, "Ignoring %d-byte binary message; clients send JSON text", len(data))
+					continue
+				}
+				handleClientMessage(cfg, c, data)
+			}
+		}
+	}()
+}
+
+// clientMessage is the JSON a client may send over its WebSocket.
+type clientMessage struct {
+	Type    string   `json:"type"`    // Message type, "subscribe" or "visibility"
+	Cmd     string   `json:"cmd"`     // Command, "pause" or "resume"; an alternative to Type
+	Paths   []string `json:"paths"`   // Path prefixes to subscribe to, relative to the watch directory
+	Visible *bool    `json:"visible"` // Whether the page is visible, for "visibility"
+}
+
+// handleClientMessage acts on a message sent by c. A "subscribe" message
+// limits c to reloads touching one of its path prefixes; an empty list
+// subscribes it to everything again. "pause" holds reloads for c until a
+// "resume", which delivers the latest one it missed. "visibility" reports
+// whether c's page is visible, which -focused-only holds reloads on in the
+// same way. Anything else is logged and ignored.
+func handleClientMessage(cfg *serverConfig, c *client, data []byte) {
+	var msg clientMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		if cfg.Verbose {
+			c.logf(slog.LevelDebug, "Ignoring unrecognized client message %q", data)
+		}
+		return
+	}
+	cmd := msg.Type
+	if msg.Cmd != "" {
+		cmd = msg.Cmd
+	}
+	switch cmd {
+	case "subscribe":
+		if cfg.Verbose {
+			c.logf(slog.LevelDebug, "Client subscribed to %q\n", msg.Paths)
+		}
+		cfg.hub.Subscribe(c, msg.Paths)
+	case "pause", "resume":
+		if cfg.Verbose {
+			c.logf(slog.LevelDebug, "Client sent %s\n", cmd)
+		}
+		cfg.hub.Pause(c, cmd == "pause")
+	case "visibility":
+		if msg.Visible == nil {
+			c.logf(slog.LevelWarn, "Ignoring visibility message without \"visible\"")
+			return
+		}
+		if cfg.Verbose {
+			c.logf(slog.LevelDebug, "Client reported its page visible: %t\n", *msg.Visible)
+		}
+		cfg.hub.SetHidden(c, !*msg.Visible)
+	default:
+		c.logf(slog.LevelWarn, "Ignoring unknown client command %q", cmd)
+	}
+}
+
+// endpointHealth is one endpoint's part of the /healthz response.
+type endpointHealth struct {
+	Path        string     `json:"path"`
+	Clients     int        `json:"clients"`
+	Watching    bool       `json:"watching"`
+	Paused      bool       `json:"paused"`
+	ReloadCount uint64     `json:"reloadCount"`
+	LastReload  *time.Time `json:"lastReload"`
+}
+
+// health returns cfg's connected clients, watcher state and reload activity.
+func health(cfg *serverConfig) endpointHealth {
+	var lastReload *time.Time
+	if ns := cfg.lastReload.Load(); ns != 0 {
+		t := time.Unix(0, ns)
+		lastReload = &t
+	}
+	return endpointHealth{
+		Path:        cfg.Path,
+		Clients:     cfg.hub.Count(),
+		Watching:    cfg.watching.Load(),
+		Paused:      cfg.paused.Load(),
+		ReloadCount: cfg.reloads.Load(),
+		LastReload:  lastReload,
+	}
+}
+
+// serveHealth reports uptime and the main endpoint's health as JSON, with
+// each mount's under "mounts". cfgs starts with the main endpoint.
+func serveHealth(cfgs []*serverConfig, w http.ResponseWriter, r *http.Request) {
+	var mounts []endpointHealth
+	for _, c := range cfgs[1:] {
+		mounts = append(mounts, health(c))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Uptime string `json:"uptime"`
+		endpointHealth
+		Mounts []endpointHealth `json:"mounts,omitempty"`
+	}{
+		Uptime:         time.Since(cfgs[0].started).Round(time.Second).String(),
+		endpointHealth: health(cfgs[0]),
+		Mounts:         mounts,
+	})
+}
+
+// checkOrigin reports whether the request's origin is in the allowlist. An
+// empty allowlist permits every origin, which keeps local development simple.
+// Requests without an Origin header don't come from a browser page and are allowed.
+func checkOrigin(cfg *serverConfig, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(cfg.AllowedOrigins) == 0 || origin == "" {
+		return true
+	}
+	for _, allowed := range cfg.AllowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	debugf(cfg, "Rejected WebSocket connection from origin %s", origin)
+	return false
+}
+
+// servePoll blocks until the next reload or longPollTimeout, whichever comes
+// first. It responds 200 with the reload message, or 204 on timeout so the
+// client can simply poll again.
+func servePoll(cfg *serverConfig, w http.ResponseWriter, r *http.Request) {
+	if !checkOrigin(cfg, r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if ok, _ := checkAuthToken(cfg, r); !ok {
+		http.Error(w, "missing or invalid auth token", http.StatusUnauthorized)
+		return
+	}
+
+	if msg := missedReload(cfg, r); msg != nil {
+		w.Write(msg)
+		return
+	}
+	if cfg.HTTPWriteTimeout > 0 {
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(longPollTimeout + cfg.HTTPWriteTimeout))
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), longPollTimeout)
+	defer cancel()
+	if msg, ok := cfg.hub.Wait(ctx); ok {
+		w.Write(msg)
+	} else if r.Context().Err() == nil {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// serveSSE streams every broadcast as a Server-Sent Event until the client
+// goes away or the server shuts down. Each event is named after the message
+// type, e.g. "reload", and carries the broadcast's sequence number as its ID,
+// so a reconnecting EventSource sends it back in Last-Event-ID and is caught
+// up like a WebSocket client passing "since". Comment lines every ping interval
+// keep proxies from timing out an idle stream.
+func serveSSE(cfg *serverConfig, w http.ResponseWriter, r *http.Request) {
+	if !checkOrigin(cfg, r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	if ok, _ := checkAuthToken(cfg, r); !ok {
+		http.Error(w, "missing or invalid auth token", http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	// The stream outlives any -http-write-timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	debugf(cfg, "SSE stream opened from %s\n", r.RemoteAddr)
+	// Send the headers right away so EventSource reports the stream as open
+	fmt.Fprintf(w, "retry: %d\n\n", clientRetry.Milliseconds())
+	since := r.URL.Query().Get("since")
+	if since == "" {
+		since = r.Header.Get("Last-Event-ID")
+	}
+	if msg := reloadSince(cfg, since); msg != nil {
+		writeSSE(w, msg, cfg.seq.Load())
+	}
+	flusher.Flush()
+
+	keepalive := cfg.PingInterval
+	if keepalive <= 0 {
+		keepalive = longPollTimeout
+	}
+	for {
+		ctx, cancel := context.WithTimeout(r.Context(), keepalive)
+		msg, ok := cfg.hub.Wait(ctx)
+		cancel()
+		switch {
+		case ok:
+			writeSSE(w, msg, cfg.seq.Load())
+		case r.Context().Err() == nil && ctx.Err() == context.DeadlineExceeded:
+			fmt.Fprint(w, ": ping\n\n")
+		default:
+			debugf(cfg, "SSE stream from %s closed\n", r.RemoteAddr)
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// clientRetry is how long an EventSource waits before reconnecting.
+const clientRetry = time.Second
+
+// writeSSE writes msg as one Server-Sent Event with the given ID, named after
+// its JSON "type" or, for plain-text messages, "reload" (or "hard-reload").
+func writeSSE(w io.Writer, msg []byte, id uint64) {
+	event := "reload"
+	var typed struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(msg, &typed) == nil && typed.Type != "" {
+		event = typed.Type
+	} else if text := string(msg); text == "hard-reload" || strings.HasPrefix(text, "hard-reload ") {
+		event = "hard-reload"
+	}
+	fmt.Fprintf(w, "event: %s\nid: %d\ndata: %s\n\n", event, id, msg)
+}
+
+// checkAuthToken reports whether r may connect under -auth-token: always
+// without one, otherwise when r carries it in the "token" query parameter or
+// as one of its offered WebSocket subprotocols. Browsers can't set headers on
+// a WebSocket, so those are the two places a page can put it. The matching
+// subprotocol, if that's where it was, is returned so it can be echoed back.
+func checkAuthToken(cfg *serverConfig, r *http.Request) (bool, string) {
+	if cfg.AuthToken == "" {
+		return true, ""
+	}
+	token := []byte(cfg.AuthToken)
+	if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), token) == 1 {
+		return true, ""
+	}
+	for _, protocol := range websocket.Subprotocols(r) {
+		if subtle.ConstantTimeCompare([]byte(protocol), token) == 1 {
+			return true, protocol
+		}
+	}
+	return false, ""
+}
+
+// triggerTokenHeader is the request header checked against Config.TriggerToken.
+const triggerTokenHeader = "X-Trigger-Token"
+
+// checkTrigger answers r with an error and reports false unless it is a POST
+// carrying the trigger token, when one is configured, in triggerTokenHeader.
+// It guards every endpoint that changes what clients are sent.
+func checkTrigger(cfg *serverConfig, w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST for "+path.Base(r.URL.Path), http.StatusMethodNotAllowed)
+		return false
+	}
+	if cfg.TriggerToken != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(triggerTokenHeader)), []byte(cfg.TriggerToken)) != 1 {
+		http.Error(w, "missing or invalid "+triggerTokenHeader, http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// serveTrigger broadcasts a reload on POST, for build pipelines that know
+// exactly when their output is ready. When a trigger token is configured the
+// request must carry it in triggerTokenHeader.
+func serveTrigger(cfg *serverConfig, w http.ResponseWriter, r *http.Request) {
+	if !checkTrigger(cfg, w, r) {
+		return
+	}
+	debugf(cfg, "Reload triggered by %s\n", r.RemoteAddr)
+	broadcastReload(cfg, fsnotify.Event{}, "reload", nil, 0)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Seq uint64 `json:"seq"`
+	}{Seq: cfg.seq.Load()})
+}
+
+// servePause pauses or resumes reloads for every client on POST, guarded
+// like the trigger endpoint. Resuming sends one catch-up reload if any was
+// held back, unless the request has ?reload=false. It answers with the new
+// state as JSON.
+func servePause(cfg *serverConfig, w http.ResponseWriter, r *http.Request, paused bool) {
+	if !checkTrigger(cfg, w, r) {
+		return
+	}
+	if paused {
+		pauseReloads(cfg)
+	} else {
+		resumeReloads(cfg, r.URL.Query().Get("reload") != "false")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Paused bool `json:"paused"`
+	}{Paused: cfg.paused.Load()})
+}
+
+// pauseReloads holds back every reload until resumeReloads.
+func pauseReloads(cfg *serverConfig) {
+	if !cfg.paused.Swap(true) {
+		infof(cfg, "Reloads paused")
+	}
+}
+
+// resumeReloads lets reloads through again and, with catchUp, sends one if
+// any was held back while paused.
+func resumeReloads(cfg *serverConfig, catchUp bool) {
+	if !cfg.paused.Swap(false) {
+		return
+	}
+	missed := cfg.missed.Swap(false)
+	infof(cfg, "Reloads resumed")
+	if missed && catchUp {
+		broadcastReload(cfg, fsnotify.Event{}, "reload", nil, 0)
+	}
+}
+
+// pingClient sends keepalive pings to c until ctx is cancelled.
+func pingClient(cfg *serverConfig, ctx context.Context, c *client) {
+	ticker := time.NewTicker(cfg.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deadline := time.Now().Add(cfg.PingInterval)
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				if cfg.Verbose {
+					c.logf(slog.LevelDebug, "WebSocket ping error: %v", err)
+				}
+				c.conn.Close() // Unblocks the read loop so it can clean up
+				return
+			}
+		}
+	}
+}
+
+// checkWatchDir makes sure a -watch entry names a readable directory or
+// regular file, so a typo fails with a message pointing at the flag rather
+// than a watcher error. It reports whether the entry is a file.
+func checkWatchDir(dir string) (bool, error) {
+	info, err := os.Stat(dir)
+	switch {
+	case os.IsNotExist(err):
+		return false, fmt.Errorf("%q does not exist; check the -watch path", dir)
+	case err != nil:
+		return false, fmt.Errorf("cannot access %q: %v", dir, err)
+	case !info.IsDir() && !info.Mode().IsRegular():
+		return false, fmt.Errorf("%q is neither a directory nor a regular file", dir)
+	}
+	return !info.IsDir(), nil
+}
+
+// reloadMessage is the JSON payload broadcast when -json-messages is set.
+type reloadMessage struct {
+	Type      string   `json:"type"`                // Message type: "reload", "hard-reload", "css", "js-update", "deleted" or "connected"
+	Path      string   `json:"path,omitempty"`      // Changed path, relative to the watch directory
+	Op        string   `json:"op,omitempty"`        // File operation, e.g. "write" or "create"
+	Paths     []string `json:"paths,omitempty"`     // Every distinct path changed since the last reload, when known
+	Files     []string `json:"files,omitempty"`     // Files to log as the cause: Paths, or just Path when Paths isn't known
+	Seq       uint64   `json:"seq"`                 // Sequence number of this broadcast
+	CacheBust bool     `json:"cacheBust,omitempty"` // Whether to reload to the page URL with a fresh _reload query parameter
+}
+
+// broadcastReload sends a message of the given kind, such as "reload" or "css", for
+// event to the connected clients interested in paths, the slash-separated
+// paths relative to their watch root that changed. Nil paths reach every client.
+// Coalesced is the number of file events the reload stands for, which is
+// recorded in the -event-log.
+func broadcastReload(cfg *serverConfig, event fsnotify.Event, kind string, paths []string, coalesced int) {
+	if cfg.DryRun {
+		if event.Name == "" {
+			logAt(slog.LevelInfo, nil, "Dry run: would broadcast %s", kind)
+		} else {
+			logAt(slog.LevelInfo, pathAttr(event.Name), "Dry run: would broadcast %s for %s %s", kind, opName(event.Op), event.Name)
+		}
+		return
+	}
+	if cfg.paused.Load() {
+		cfg.missed.Store(true)
+		if event.Name == "" {
+			infof(cfg, "Reloads paused, holding back %s", kind)
+		} else {
+			infof(cfg, "Reloads paused, holding back %s for %s %s", kind, opName(event.Op), event.Name)
+		}
+		return
+	}
+	cfg.reloads.Add(1)
+	cfg.lastReload.Store(time.Now().UnixNano())
+	seq := cfg.seq.Add(1)
+	cfg.hub.Broadcast(reloadPayload(cfg, event, kind, paths, seq), paths)
+	if cfg.events != nil {
+		cfg.events.record(cfg, event, kind, coalesced, seq)
+	}
+}
+
+// isHardReload reports whether event calls for a hard reload: with
+// -hard-reload set, or when it matches a -hard-reload-pattern entry, using the
+// same matching as -ignore.
+func isHardReload(cfg *serverConfig, event fsnotify.Event) bool {
+	if cfg.HardReload {
+		return true
+	}
+	_, rel := relPath(cfg, event.Name)
+	for _, pattern := range cfg.HardReloadPatterns {
+		if pattern != "" && matchPattern(pattern, filepath.Base(event.Name), rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// hotSwap returns the message kind that applies event in place rather than
+// reloading the page: "css" for a stylesheet with -hot-css, "js-update" for
+// a JavaScript module under an -hmr-dir, or "" if it needs a reload. Removing
+// or renaming a file still reloads, since the page would point at nothing.
+func hotSwap(cfg *serverConfig, event fsnotify.Event) string {
+	if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+		return ""
+	}
+	switch ext := strings.ToLower(filepath.Ext(event.Name)); {
+	case ext == ".css" && cfg.HotCSS:
+		return "css"
+	case (ext == ".js" || ext == ".mjs") && inHMRDir(cfg, event.Name):
+		return "js-update"
+	}
+	return ""
+}
+
+// inHMRDir reports whether name lies under one of the -hmr-dir directories,
+// which are relative to name's watch root.
+func inHMRDir(cfg *serverConfig, name string) bool {
+	_, rel := relPath(cfg, name)
+	rel = filepath.ToSlash(rel)
+	for _, dir := range cfg.HMRDirs {
+		dir = strings.Trim(path.Clean("/"+filepath.ToSlash(dir)), "/")
+		if dir == "" || strings.HasPrefix(rel, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// missedReload returns a reload message if broadcasts happened after the
+// sequence number in the request's "since" query parameter, so a client
+// reconnecting after sleep or a dropped connection doesn't keep a stale page.
+// It returns nil when the client is up to date or didn't send "since".
+func missedReload(cfg *serverConfig, r *http.Request) []byte {
+	return reloadSince(cfg, r.URL.Query().Get("since"))
+}
+
+// reloadSince returns a reload message if broadcasts happened after the
+// sequence number in since, or nil if there were none or since isn't one.
+func reloadSince(cfg *serverConfig, since string) []byte {
+	seen, err := strconv.ParseUint(since, 10, 64)
+	if err != nil {
+		return nil
+	}
+	seq := cfg.seq.Load()
+	if seq <= seen {
+		return nil
+	}
+	return reloadPayload(cfg, fsnotify.Event{}, "reload", nil, seq)
+}
+
+// recentReload returns the latest broadcast if it went out within
+// -recent-reload-window, for a client connecting right after a build whose
+// reload it just missed. Clients that send "since" are left to missedReload,
+// which knows exactly what they have seen.
+func recentReload(cfg *serverConfig, r *http.Request) []byte {
+	if cfg.RecentReloadWindow <= 0 || r.URL.Query().Has("since") {
+		return nil
+	}
+	return cfg.hub.Recent(cfg.RecentReloadWindow)
+}
+
+// handshakePayload builds the message sent to a client as soon as its
+// WebSocket opens: plain "connected", or a reloadMessage of type "connected"
+// carrying the current sequence number when -json-messages is set.
+func handshakePayload(cfg *serverConfig) []byte {
+	if !cfg.JSONMessages {
+		return []byte("connected")
+	}
+	msg, _ := json.Marshal(reloadMessage{Type: "connected", Seq: cfg.seq.Load()})
+	return msg
+}
+
+// logDecision explains in dry-run mode what was decided for event.
+func logDecision(cfg *serverConfig, event fsnotify.Event, decision string) {
+	if cfg.DryRun {
+		logAt(slog.LevelInfo, pathAttr(event.Name), "Dry run: %s %s: %s", opName(event.Op), event.Name, decision)
+	}
+}
+
+// reloadPayload builds the message of the given kind sent to clients for
+// event: the plain-text reload message by default, followed by the changed
+// path with -append-path, or a reloadMessage as JSON when -json-messages is
+// set, listing paths. An event without a name produces
+// a message without path and op.
+func reloadPayload(cfg *serverConfig, event fsnotify.Event, kind string, paths []string, seq uint64) []byte {
+	if !cfg.JSONMessages {
+		text := cfg.ReloadMessage
+		if kind == "hard-reload" {
+			text = kind
+		}
+		if cfg.AppendPath && event.Name != "" {
+			_, rel := relPath(cfg, event.Name)
+			text += " " + filepath.ToSlash(rel)
+		}
+		return []byte(text)
+	}
+	msg := reloadMessage{Type: kind, Paths: paths, Seq: seq}
+	switch kind {
+	case "reload", "hard-reload", "deleted":
+		msg.CacheBust = cfg.CacheBust
+	}
+	if event.Name != "" {
+		_, rel := relPath(cfg, event.Name)
+		msg.Path = filepath.ToSlash(rel)
+		msg.Op = opName(event.Op)
+	}
+	msg.Files = paths
+	if msg.Files == nil && msg.Path != "" {
+		msg.Files = []string{msg.Path}
+	}
+	data, _ := json.Marshal(msg)
+	return data
+}
+
+// opNames lists the operations in ops, e.g. "write, create".
+func opNames(ops fsnotify.Op) string {
+	var names []string
+	for _, op := range []fsnotify.Op{fsnotify.Write, fsnotify.Create, fsnotify.Remove, fsnotify.Rename, fsnotify.Chmod} {
+		if ops.Has(op) {
+			names = append(names, opName(op))
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// opName returns a lowercase name for the most significant operation in op.
+func opName(op fsnotify.Op) string {
+	switch {
+	case op.Has(fsnotify.Create):
+		return "create"
+	case op.Has(fsnotify.Write):
+		return "write"
+	case op.Has(fsnotify.Remove):
+		return "remove"
+	case op.Has(fsnotify.Rename):
+		return "rename"
+	case op.Has(fsnotify.Chmod):
+		return "chmod"
+	}
+	return strings.ToLower(op.String())
+}
@@ -0,0 +1,359 @@
+package livereload
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testTimeout bounds how long a test waits for something the server should do.
+const testTimeout = 5 * time.Second
+
+// startTestServer starts a server for cfg on an ephemeral local port and
+// dials its WebSocket endpoint with a real client. Unless cfg names its own,
+// a fresh temporary directory is watched; see testWatchDir. Everything is
+// shut down when the test ends.
+func startTestServer(t *testing.T, cfg Config) (*Server, *websocket.Conn) {
+	t.Helper()
+	srv := runTestServer(t, cfg)
+	return srv, dialTestServer(t, srv)
+}
+
+// runTestServer starts a server for cfg like startTestServer, without
+// connecting to it.
+func runTestServer(t *testing.T, cfg Config) *Server {
+	t.Helper()
+	cfg.Host, cfg.Port = "127.0.0.1", "0"
+	if len(cfg.WatchDirs) == 0 && !cfg.NoWatch {
+		cfg.WatchDirs = []string{t.TempDir()}
+	}
+	if cfg.LogLevel == "" && !cfg.Verbose {
+		cfg.LogLevel = "error"
+	}
+	srv := New(cfg)
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		srv.Shutdown(ctx)
+	})
+	return srv
+}
+
+// dialTestServer connects a WebSocket client to srv's main endpoint and waits
+// until the hub has registered it, so broadcasts from then on reach it.
+func dialTestServer(t *testing.T, srv *Server) *websocket.Conn {
+	t.Helper()
+	conn, err := dialEndpoint(srv, srv.cfg.Path)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	waitFor(t, "client to register", func() bool { return srv.cfg.hub.Count() > 0 })
+	return conn
+}
+
+// dialEndpoint opens a WebSocket to the endpoint at path on srv.
+func dialEndpoint(srv *Server, path string) (*websocket.Conn, error) {
+	conn, resp, err := websocket.DefaultDialer.Dial("ws://"+srv.Addr().String()+path, nil)
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return conn, err
+}
+
+// testWatchDir returns the first directory srv watches.
+func testWatchDir(srv *Server) string {
+	return srv.cfg.WatchDirs[0]
+}
+
+// waitFor polls cond until it holds, failing the test after testTimeout.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// expectMessage reads the next message from conn and checks it is want.
+func expectMessage(t *testing.T, conn *websocket.Conn, want string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("waiting for %q: %v", want, err)
+	}
+	if string(data) != want {
+		t.Fatalf("got message %q, want %q", data, want)
+	}
+}
+
+// expectNoMessage checks that conn receives nothing for d.
+func expectNoMessage(t *testing.T, conn *websocket.Conn, d time.Duration) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(d))
+	if _, data, err := conn.ReadMessage(); err == nil {
+		t.Fatalf("got unexpected message %q", data)
+	}
+}
+
+// writeFile writes content to path, failing the test on error.
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadOnFileChange(t *testing.T) {
+	srv, conn := startTestServer(t, Config{})
+	writeFile(t, filepath.Join(testWatchDir(srv), "index.html"), "<h1>hi</h1>")
+	expectMessage(t, conn, "reload")
+}
+
+func TestReloadMessageFiles(t *testing.T) {
+	srv, conn := startTestServer(t, Config{JSONMessages: true, Debounce: 50 * time.Millisecond})
+	writeFile(t, filepath.Join(testWatchDir(srv), "app.js"), "x")
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	var msg reloadMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != "reload" || !slices.Equal(msg.Files, []string{"app.js"}) {
+		t.Fatalf("got %+v, want a reload with files [app.js]", msg)
+	}
+}
+
+func TestUnresponsiveClientUnregistered(t *testing.T) {
+	srv := runTestServer(t, Config{PingInterval: 50 * time.Millisecond})
+	// Pongs are sent from ReadMessage, so a reader answers pings and a client
+	// that never reads goes silent
+	live := dialTestServer(t, srv)
+	go func() {
+		for {
+			if _, _, err := live.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	silent, err := dialEndpoint(srv, srv.cfg.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	waitFor(t, "both clients to register", func() bool { return srv.cfg.hub.Count() == 2 })
+	waitFor(t, "the silent client to be dropped", func() bool { return srv.cfg.hub.Count() == 1 })
+	// The live client outlasts several pong deadlines
+	time.Sleep(300 * time.Millisecond)
+	if n := srv.cfg.hub.Count(); n != 1 {
+		t.Fatalf("%d clients registered, want the live one only", n)
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		origin  string
+		want    bool
+	}{
+		{"empty list allows any origin", nil, "http://evil.example", true},
+		{"empty list allows no origin", nil, "", true},
+		{"allowed", []string{"http://localhost:3000"}, "http://localhost:3000", true},
+		{"allowed with trailing slash and other case", []string{"http://LocalHost:3000/"}, "http://localhost:3000", true},
+		{"one of several", []string{"http://a.test", "http://b.test"}, "http://b.test", true},
+		{"disallowed", []string{"http://localhost:3000"}, "http://evil.example", false},
+		{"other port", []string{"http://localhost:3000"}, "http://localhost:3001", false},
+		{"no origin header", []string{"http://localhost:3000"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &serverConfig{Config: Config{AllowedOrigins: tt.allowed}}
+			r := httptest.NewRequest(http.MethodGet, "/refreshMeDaddy", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if got := checkOrigin(cfg, r); got != tt.want {
+				t.Errorf("checkOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDisallowedOriginRefused(t *testing.T) {
+	srv := runTestServer(t, Config{AllowedOrigins: []string{"http://localhost:3000"}})
+	url := "ws://" + srv.Addr().String() + srv.cfg.Path
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"http://evil.example"}})
+	if err == nil {
+		t.Fatal("connection from a disallowed origin succeeded")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("got response %v, want 403", resp)
+	}
+	resp.Body.Close()
+	conn, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"http://localhost:3000"}})
+	if err != nil {
+		t.Fatalf("connection from an allowed origin failed: %v", err)
+	}
+	resp.Body.Close()
+	conn.Close()
+}
+
+func TestShutdownSendsCloseFrame(t *testing.T) {
+	srv, conn := startTestServer(t, Config{})
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	_, _, err := conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) {
+		t.Fatalf("got %v, want a close frame", err)
+	}
+	if closeErr.Code != websocket.CloseGoingAway || closeErr.Text != closeReason {
+		t.Fatalf("got close %d %q, want %d %q", closeErr.Code, closeErr.Text, websocket.CloseGoingAway, closeReason)
+	}
+}
+
+func TestMaxClients(t *testing.T) {
+	const limit = 3
+	srv := runTestServer(t, Config{NoWatch: true, MaxClients: limit})
+	conns := make([]*websocket.Conn, limit)
+	for i := range conns {
+		conn, err := dialEndpoint(srv, srv.cfg.Path)
+		if err != nil {
+			t.Fatalf("client %d of %d refused: %v", i+1, limit, err)
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+	url := "ws://" + srv.Addr().String() + srv.cfg.Path
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil {
+		t.Fatalf("client %d connected past the limit", limit+1)
+	}
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("got response %v, want 503", resp)
+	}
+	resp.Body.Close()
+
+	// A client leaving frees its slot
+	conns[0].Close()
+	waitFor(t, "the first client to unregister", func() bool { return srv.cfg.hub.Count() == limit-1 })
+	conn, err := dialEndpoint(srv, srv.cfg.Path)
+	if err != nil {
+		t.Fatalf("client refused after a slot was freed: %v", err)
+	}
+	conn.Close()
+}
+
+func TestIdle(t *testing.T) {
+	const timeout = 300 * time.Millisecond
+	srv, conn := startTestServer(t, Config{NoWatch: true, IdleTimeout: timeout})
+	select {
+	case <-srv.Idle():
+		t.Fatal("idle while a client is connected")
+	case <-time.After(2 * timeout):
+	}
+
+	conn.Close()
+	left := time.Now()
+	waitFor(t, "the client to unregister", func() bool { return srv.cfg.hub.Count() == 0 })
+	select {
+	case <-srv.Idle():
+		t.Fatalf("idle %s after the last client left, before the %s timeout", time.Since(left), timeout)
+	case <-time.After(timeout / 2):
+	}
+	select {
+	case <-srv.Idle():
+		if d := time.Since(left); d < timeout {
+			t.Fatalf("idle after %s, want at least %s", d, timeout)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("not idle after the last client left")
+	}
+}
+
+func TestIdleCanceledByReconnect(t *testing.T) {
+	const timeout = 300 * time.Millisecond
+	srv, conn := startTestServer(t, Config{NoWatch: true, IdleTimeout: timeout})
+	conn.Close()
+	waitFor(t, "the client to unregister", func() bool { return srv.cfg.hub.Count() == 0 })
+	dialTestServer(t, srv)
+	select {
+	case <-srv.Idle():
+		t.Fatal("idle although a client reconnected within the timeout")
+	case <-time.After(2 * timeout):
+	}
+}
+
+func TestHealthAndMetricsCoverMounts(t *testing.T) {
+	srv := runTestServer(t, Config{Mounts: []Mount{{Path: "/reload/docs", WatchDirs: []string{t.TempDir()}}}})
+	conn, err := dialEndpoint(srv, "/reload/docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitFor(t, "the mount's client to register", func() bool { return srv.mounts[0].hub.Count() == 1 })
+
+	resp, err := http.Get("http://" + srv.Addr().String() + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var health struct {
+		Path    string
+		Clients int
+		Mounts  []struct {
+			Path    string
+			Clients int
+		}
+	}
+	err = json.NewDecoder(resp.Body).Decode(&health)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health.Path != srv.cfg.Path || health.Clients != 0 {
+		t.Errorf("main endpoint reported as %q with %d clients, want %q with 0", health.Path, health.Clients, srv.cfg.Path)
+	}
+	if len(health.Mounts) != 1 || health.Mounts[0].Path != "/reload/docs" || health.Mounts[0].Clients != 1 {
+		t.Errorf("mounts = %+v, want /reload/docs with 1 client", health.Mounts)
+	}
+
+	resp, err = http.Get("http://" + srv.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`refreshmedaddy_connected_clients{path="` + srv.cfg.Path + `"} 0`,
+		`refreshmedaddy_connected_clients{path="/reload/docs"} 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics don't contain %s:\n%s", want, body)
+		}
+	}
+}
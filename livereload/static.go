@@ -0,0 +1,262 @@
+package livereload
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// clientJS is the live-reload client served at the endpoint path plus ".js".
+//
+//go:embed client.js
+var clientJS []byte
+
+// Placeholders in client.js that serveClientJS fills in.
+var (
+	seqPlaceholder       = []byte("0 /* seq */")
+	pathPlaceholder      = []byte(`"/refreshMeDaddy" /* path */`)
+	messagePlaceholder   = []byte(`"reload" /* reload message */`)
+	reconnectPlaceholder = []byte("true /* reload on reconnect */")
+)
+
+// serveClientJS serves the embedded live-reload client script, stamped with
+// the endpoint path, the reload message text, whether to reload on
+// reconnect and the current broadcast
+// sequence number so the client can ask to be caught up on reloads it misses
+// while disconnected.
+func serveClientJS(cfg *serverConfig, w http.ResponseWriter, r *http.Request) {
+	seq := []byte(strconv.FormatUint(cfg.seq.Load(), 10))
+	path, _ := json.Marshal(cfg.BasePath + cfg.Path)
+	message, _ := json.Marshal(cfg.ReloadMessage)
+	js := bytes.Replace(clientJS, pathPlaceholder, path, 1)
+	js = bytes.Replace(js, messagePlaceholder, message, 1)
+	js = bytes.Replace(js, seqPlaceholder, seq, 1)
+	if cfg.NoReconnectReload {
+		js = bytes.Replace(js, reconnectPlaceholder, []byte("false"), 1)
+	}
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(js)
+}
+
+// injectHandler serves files from a directory and injects the live-reload
+// client script into every HTML response.
+type injectHandler struct {
+	files   http.Handler // Underlying file server
+	tag     []byte       // Script tag to inject
+	overlay bool         // Replace 404 responses with notFoundTemplate
+}
+
+// newInjectHandler returns a handler serving dir with a script tag loading
+// the client from scriptPath injected into HTML. The client derives the
+// WebSocket URL from the host it was loaded from. With overlay, missing files
+// get a page that reloads once they appear instead of a bare 404.
+func newInjectHandler(dir, scriptPath string, overlay bool) *injectHandler {
+	return &injectHandler{
+		files:   http.FileServer(http.Dir(dir)),
+		tag:     []byte(`<script src="` + html.EscapeString(scriptPath) + `"></script>` + "\n"),
+		overlay: overlay,
+	}
+}
+
+// ServeHTTP serves the request, buffering and rewriting HTML responses.
+func (h *injectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Ranges would hand us a fragment of the page to rewrite, so always ask for the whole file
+	r.Header.Del("Range")
+	bw := &bufferedWriter{ResponseWriter: w, notFound: h.overlay}
+	h.files.ServeHTTP(bw, r)
+	if !bw.buffering {
+		return
+	}
+	if bw.status == http.StatusNotFound {
+		serveNotFoundOverlay(w, r, h.tag)
+		return
+	}
+	body := injectScript(bw.buf.Bytes(), h.tag)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(bw.status)
+	w.Write(body)
+}
+
+// notFoundTemplate is the overlay served with -not-found-overlay for a path
+// that doesn't exist, e.g. while a build is failing. It carries the client
+// script, so the page stays connected and reloads on the next change. The
+// %[1]s verb receives the escaped path and %[2]s the script tag.
+const notFoundTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Not found: %[1]s</title>
+<style>
+  body { margin: 0; font-family: system-ui, sans-serif; background: #1e1e24; color: #e8e8ee; }
+  main { max-width: 40rem; margin: 15vh auto; padding: 2rem; border-left: 4px solid #e0567a; background: #2a2a33; }
+  h1 { margin-top: 0; font-size: 1.25rem; color: #e0567a; }
+  code { padding: 0.1rem 0.3rem; background: #1e1e24; word-break: break-all; }
+  p:last-child { margin-bottom: 0; color: #a0a0ad; }
+</style>
+</head>
+<body>
+<main>
+<h1>RefreshMeDaddy: 404 Not Found</h1>
+<p>Nothing is served at <code>%[1]s</code> yet.</p>
+<p>This page stays connected and reloads as soon as something changes, e.g. once your build is fixed.</p>
+</main>
+%[2]s</body>
+</html>
+`
+
+// serveNotFoundOverlay answers a request for a missing file with
+// notFoundTemplate and a 404 status.
+func serveNotFoundOverlay(w http.ResponseWriter, r *http.Request, tag []byte) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintf(w, notFoundTemplate, html.EscapeString(r.URL.Path), tag)
+}
+
+// injectScript inserts script right before the closing body tag, or appends it if there is none.
+func injectScript(body, script []byte) []byte {
+	i := bytes.LastIndex(bytes.ToLower(body), []byte("</body>"))
+	if i < 0 {
+		return append(body, script...)
+	}
+	out := make([]byte, 0, len(body)+len(script))
+	out = append(out, body[:i]...)
+	out = append(out, script...)
+	return append(out, body[i:]...)
+}
+
+// bufferedWriter holds back successful HTML responses, and 404s when notFound
+// is set, so they can be rewritten, and passes everything else straight
+// through to the underlying writer.
+type bufferedWriter struct {
+	http.ResponseWriter
+	buf       bytes.Buffer // Buffered HTML body
+	status    int          // Status code of the buffered response
+	buffering bool         // Whether the response is being buffered
+	notFound  bool         // Also buffer 404 responses, to be replaced by an overlay
+	wrote     bool         // Whether the header has been written
+}
+
+// WriteHeader decides whether to buffer the response based on its status and content type.
+func (b *bufferedWriter) WriteHeader(status int) {
+	if b.wrote {
+		return
+	}
+	b.wrote = true
+	b.status = status
+	if status == http.StatusOK && strings.HasPrefix(b.Header().Get("Content-Type"), "text/html") || status == http.StatusNotFound && b.notFound {
+		b.buffering = true
+		b.Header().Del("Content-Length")
+		return
+	}
+	b.ResponseWriter.WriteHeader(status)
+}
+
+// Write buffers HTML bodies and forwards any other content unchanged.
+func (b *bufferedWriter) Write(p []byte) (int, error) {
+	if !b.wrote {
+		b.WriteHeader(http.StatusOK)
+	}
+	if b.buffering {
+		return b.buf.Write(p)
+	}
+	return b.ResponseWriter.Write(p)
+}
+
+// snippetTemplate is the standalone client printed by -print-snippet. The %[1]s
+// verb receives the JSON-encoded WebSocket URL and %[2]s the reload message.
+// Message types come from the first word of plain-text messages or the type
+// of JSON ones.
+const snippetTemplate = `<script type="text/javascript">
+  (function connect() {
+    var ws = new WebSocket(%[1]s);
+    ws.onmessage = function (event) {
+      var data = event.data;
+      var type = data.split(" ")[0];
+      if (data.charAt(0) === "{") {
+        try {
+          type = JSON.parse(data).type;
+        } catch (e) {}
+      }
+      if (type === "hard-reload") {
+        window.location.reload(true);
+      } else if (data === %[2]s || data.indexOf(%[2]s + " ") === 0 || type === "reload" || type === "deleted") {
+        window.location.reload();
+      }
+    };
+    ws.onclose = function () {
+      setTimeout(connect, 1000);
+    };
+  })();
+</script>
+`
+
+// snippet returns a ready-to-paste script tag connecting to the configured
+// endpoint, using wss when TLS is enabled. The host is localhost unless the
+// server listens on one specific address.
+func snippet(cfg *serverConfig) string {
+	scheme := "ws"
+	if cfg.TLSCert != "" {
+		scheme = "wss"
+	}
+	host := "localhost"
+	if ip := net.ParseIP(cfg.Host); cfg.Host != "" && (ip == nil || !ip.IsUnspecified()) {
+		host = cfg.Host
+	}
+	endpoint := scheme + "://" + net.JoinHostPort(host, cfg.Port) + cfg.BasePath + cfg.Path
+	if cfg.AuthToken != "" {
+		endpoint += "?token=" + url.QueryEscape(cfg.AuthToken)
+	}
+	url, _ := json.Marshal(endpoint)
+	message, _ := json.Marshal(cfg.ReloadMessage)
+	return fmt.Sprintf(snippetTemplate, url, message)
+}
+
+// scriptURL returns the path the client script is served at, with the
+// -auth-token the script should pass on when one is set. It is only used in
+// pages the server injects the script into.
+func scriptURL(cfg *serverConfig) string {
+	script := cfg.BasePath + cfg.Path + ".js"
+	if cfg.AuthToken != "" {
+		script += "?token=" + url.QueryEscape(cfg.AuthToken)
+	}
+	return script
+}
+
+// endpointInfoTemplate is the page served when the WebSocket endpoint is
+// opened without upgrading, e.g. straight from the browser's address bar. The
+// %[1]s verb receives the escaped script URL.
+const endpointInfoTemplate = `<!DOCTYPE html>
+<html>
+<head><title>RefreshMeDaddy</title></head>
+<body>
+<h1>RefreshMeDaddy</h1>
+<p>This endpoint expects a WebSocket connection from the live-reload client, not a page visit.</p>
+<p>Add the client to your pages with:</p>
+<pre>&lt;script src="%[1]s"&gt;&lt;/script&gt;</pre>
+<p>or run the server with <code>-print-snippet</code> for a standalone snippet.</p>
+</body>
+</html>
+`
+
+// serveEndpointInfo answers a plain HTTP request to the WebSocket endpoint
+// with a short page explaining how to connect, instead of a bare upgrade error.
+func serveEndpointInfo(cfg *serverConfig, w http.ResponseWriter, r *http.Request) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	script := scheme + "://" + r.Host + cfg.BasePath + cfg.Path + ".js"
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Upgrade", "websocket")
+	w.WriteHeader(http.StatusUpgradeRequired)
+	fmt.Fprintf(w, endpointInfoTemplate, html.EscapeString(script))
+}
@@ -0,0 +1,911 @@
+package livereload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// dirWatcher is the part of fsnotify.Watcher that watchFiles relies on; both
+// fsnotify.Watcher and pollWatcher satisfy it. Add must be safe to call from
+// several goroutines at once, since large trees are walked concurrently.
+type dirWatcher interface {
+	Add(name string) error
+	Remove(name string) error
+	Close() error
+}
+
+// newWatcher creates the configured watcher backend and returns it with its
+// event and error channels: a native fsnotify watcher by default, or a
+// stat-based poller when -poll is set.
+func newWatcher(cfg *serverConfig) (dirWatcher, <-chan fsnotify.Event, <-chan error, error) {
+	if cfg.Poll {
+		p := newPollWatcher(cfg.PollInterval)
+		return p, p.Events, p.Errors, nil
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return w, w.Events, w.Errors, nil
+}
+
+// watchFiles watches for file changes in the watch directories and notifies
+// connected clients. It reports on ready whether the initial watches were set
+// up, returning straight away if they weren't.
+func watchFiles(cfg *serverConfig, ctx context.Context, ready chan<- error) {
+	watcher, events, errs, err := newWatcher(cfg)
+	if err != nil {
+		ready <- fmt.Errorf("creating watcher: %w", err)
+		return
+	}
+	// The watcher is replaced if it dies, so close whichever one is current
+	defer func() { watcher.Close() }()
+
+	// watched tracks every directory added to the watcher, so removals can be
+	// recognized as directories after they're gone from disk
+	watched := make(map[string]bool)
+
+	// With hash checks on, hashes holds the content hash of each watched file
+	// and edited the files touched since the last reload. The initial walk
+	// records a baseline for every file, and later files are hashed once
+	// their burst settles, so a save that truncates and rewrites a file
+	// isn't mistaken for a change.
+	var (
+		hashes map[string]uint64
+		edited map[string]fsnotify.Event
+		forced bool // A directory changed, which always reloads
+	)
+	if cfg.HashCheck {
+		hashes = make(map[string]uint64)
+		edited = make(map[string]fsnotify.Event)
+	}
+
+	// unreadable decides what a failure to watch or list dir means: fatal for
+	// a watch root or with -strict, otherwise logged and the directory skipped
+	unreadable := func(dir string, err error) error {
+		if cfg.Strict || watchRoot(cfg, dir) != "" {
+			return err
+		}
+		warnf("Skipping unreadable directory: %v", err)
+		return nil
+	}
+
+	// With -follow-symlinks, realDirs maps the resolved path of each watched
+	// directory to the path it is watched under, so a symlink back up the tree
+	// or a second link to the same directory isn't walked again
+	var realDirs map[string]string
+	if cfg.FollowSymlinks {
+		realDirs = make(map[string]string)
+	}
+
+	// visit watches a single directory, ignoring specified paths and stopping
+	// at -max-depth and -max-watches, and returns its subdirectories. It may
+	// run on several goroutines at once during a walk, so walkMu guards
+	// watched, realDirs, capped and, while initial is set, hashes.
+	var (
+		walkMu  sync.Mutex
+		capped  bool
+		initial = true // Still in the walk that runs before ready
+	)
+
+	// baseline records the hash of a file found by the initial walk, so that
+	// touching it without changing its content doesn't reload even the first
+	// time. Files that appear later have no baseline and always reload.
+	baseline := func(path string) {
+		if hashes == nil || !initial {
+			return
+		}
+		if sum, ok := hashFile(path); ok {
+			walkMu.Lock()
+			hashes[filepath.Clean(path)] = sum
+			walkMu.Unlock()
+		}
+	}
+	visit := func(dir string) ([]string, error) {
+		real := ""
+		if realDirs != nil {
+			real = dir
+			if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+				real = resolved
+			}
+		} else if watchRoot(cfg, dir) == "" {
+			// A symlink created after startup isn't followed either
+			if info, err := os.Lstat(dir); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+				return nil, nil
+			}
+		}
+		if shouldIgnore(cfg, dir, true) {
+			debugPathf(cfg, dir, "Ignoring directory: %s\n", dir)
+			return nil, nil
+		}
+		if cfg.MaxDepth > 0 && dirDepth(cfg, dir) >= cfg.MaxDepth {
+			debugPathf(cfg, dir, "Not watching %s: deeper than -max-depth\n", dir)
+			return nil, nil
+		}
+		// Claim the directory before adding it, so two links to the same real
+		// directory can't both be walked and the limit can't be overshot
+		walkMu.Lock()
+		if prev, ok := realDirs[real]; ok {
+			walkMu.Unlock()
+			debugPathf(cfg, dir, "Not watching %s: already watched as %s\n", dir, prev)
+			return nil, nil
+		}
+		if cfg.MaxWatches > 0 && len(watched) >= cfg.MaxWatches {
+			if !capped {
+				warnf("Warning: reached -max-watches limit of %d directories, not watching %s or any further directories", cfg.MaxWatches, dir)
+				capped = true
+			}
+			walkMu.Unlock()
+			return nil, nil
+		}
+		watched[filepath.Clean(dir)] = true
+		if realDirs != nil {
+			realDirs[real] = filepath.Clean(dir)
+		}
+		walkMu.Unlock()
+
+		if err := watcher.Add(dir); err != nil {
+			walkMu.Lock()
+			delete(watched, filepath.Clean(dir))
+			if realDirs != nil {
+				delete(realDirs, real)
+			}
+			count := len(watched)
+			walkMu.Unlock()
+			if errors.Is(err, syscall.ENOSPC) {
+				return nil, fmt.Errorf("watching %s: %w: the system limit on file watches was reached after %d directories; "+
+					"skip large directories with -ignore or raise the limit, e.g. sudo sysctl fs.inotify.max_user_watches=524288", dir, err, count)
+			}
+			return nil, unreadable(dir, fmt.Errorf("watching %s: %w", dir, err))
+		}
+		debugPathf(cfg, dir, "Watching directory: %s\n", dir)
+		if cfg.gitignore != nil {
+			if err := loadGitignore(cfg, dir); err != nil {
+				warnf("Failed to read .gitignore in %s: %v", dir, err)
+			}
+		}
+		contents, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, unreadable(dir, err)
+		}
+		var subdirs []string
+		for _, d := range contents {
+			isDir := d.IsDir()
+			if !isDir && realDirs != nil && d.Type()&fs.ModeSymlink != 0 {
+				info, err := os.Stat(filepath.Join(dir, d.Name()))
+				isDir = err == nil && info.IsDir()
+			}
+			path := filepath.Join(dir, d.Name())
+			if isDir {
+				subdirs = append(subdirs, path)
+			} else if !shouldIgnore(cfg, path, false) && hasWatchedExt(cfg, path) {
+				baseline(path)
+			}
+		}
+		return subdirs, nil
+	}
+
+	// addDir watches dir and every directory beneath it. Subdirectories are
+	// handed to up to walkWorkers goroutines, or walked inline when all are
+	// busy, so a large tree is listed concurrently without unbounded
+	// goroutines. The first error stops the walk and is returned once every
+	// goroutine has finished.
+	addDir := func(dir string) error {
+		var (
+			wg       sync.WaitGroup
+			sem      = make(chan struct{}, walkWorkers)
+			errMu    sync.Mutex
+			firstErr error
+		)
+		failed := func() bool {
+			errMu.Lock()
+			defer errMu.Unlock()
+			return firstErr != nil
+		}
+		var walk func(dir string)
+		walk = func(dir string) {
+			if failed() {
+				return
+			}
+			subdirs, err := visit(dir)
+			if err != nil {
+				errMu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errMu.Unlock()
+				return
+			}
+			for _, sub := range subdirs {
+				select {
+				case sem <- struct{}{}:
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						defer func() { <-sem }()
+						walk(sub)
+					}()
+				default:
+					walk(sub)
+				}
+			}
+		}
+		walk(dir)
+		wg.Wait()
+		return firstErr
+	}
+
+	// addRoot starts watching a watch root. A root naming a single file is
+	// watched through its parent directory, without descending into it, and
+	// events for the file's siblings are dropped in the event loop.
+	addRoot := func(root string) error {
+		if !isFileRoot(cfg, root) {
+			return addDir(root)
+		}
+		dir := rootDir(cfg, root)
+		if watched[dir] {
+			return nil // Shared with another file, or already under a directory root
+		}
+		if err := watcher.Add(dir); err != nil {
+			return fmt.Errorf("watching %s: %w", dir, err)
+		}
+		watched[dir] = true
+		baseline(root)
+		debugPathf(cfg, root, "Watching file: %s\n", root)
+		return nil
+	}
+
+	// removeDir drops dir and every watched directory beneath it. A renamed
+	// directory comes back through the Create event for its new name.
+	removeDir := func(dir string) {
+		prefix := dir + string(filepath.Separator)
+		for path := range watched {
+			if path == dir || strings.HasPrefix(path, prefix) {
+				watcher.Remove(path) // The kernel may already have dropped it
+				delete(watched, path)
+				for real, watchedAs := range realDirs {
+					if watchedAs == path {
+						delete(realDirs, real)
+					}
+				}
+				debugPathf(cfg, path, "Stopped watching directory: %s\n", path)
+			}
+		}
+	}
+
+	// A watch root that is deleted or moved away, e.g. by a build that wipes
+	// its output directory, is polled for with backoff until it exists again
+	// and then handed back to the event loop on recovered to be re-watched.
+	recovered := make(chan string)
+	lost := make(map[string]bool)
+	waitForRoot := func(root string) {
+		delay := rootRetryMin
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			if info, err := os.Stat(root); err == nil && (info.IsDir() || isFileRoot(cfg, root)) {
+				select {
+				case recovered <- root:
+				case <-ctx.Done():
+				}
+				return
+			}
+			delay = min(2*delay, rootRetryMax)
+		}
+	}
+
+	// restartWatcher replaces a watcher whose channels closed under us and
+	// re-adds every watch root that still exists. Attempts back off from
+	// restartMin to restartMax, and only reset once a watcher has survived
+	// restartMax, so one that keeps dying can't spin. It reports false if ctx
+	// ended first.
+	var (
+		restartDelay time.Duration
+		restartedAt  time.Time
+	)
+	restartWatcher := func() bool {
+		watcher.Close()
+		if restartDelay == 0 || time.Since(restartedAt) > restartMax {
+			restartDelay = restartMin
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return false
+			case <-time.After(restartDelay):
+			}
+			restartDelay = min(2*restartDelay, restartMax)
+			w, ev, er, err := newWatcher(cfg)
+			if err != nil {
+				errorf("Failed to recreate watcher: %v; retrying in %s", err, restartDelay)
+				continue
+			}
+			watcher, events, errs = w, ev, er
+			restartedAt = time.Now()
+			clear(watched)
+			clear(realDirs)
+			for _, root := range cfg.WatchDirs {
+				if lost[root] {
+					continue // Re-added by waitForRoot once it's back
+				}
+				if err := addRoot(root); err != nil {
+					errorf("Failed to watch %s again: %v", root, err)
+				}
+			}
+			infof(cfg, "Watcher restarted, watching %d directories", len(watched))
+			return true
+		}
+	}
+
+	for _, root := range cfg.WatchDirs {
+		if err := addRoot(root); err != nil {
+			ready <- fmt.Errorf("adding directory to watcher: %w", err)
+			return
+		}
+	}
+	initial = false
+	debugf(cfg, "Watching %d directories\n", len(watched))
+	cfg.watching.Store(true)
+	defer cfg.watching.Store(false)
+	ready <- nil
+
+	// Debounce state: the timer is armed on the first event of a burst and
+	// reset on each following event, but never past maxDelay from the first.
+	var (
+		timer      *time.Timer
+		timerC     <-chan time.Time
+		burstStart time.Time
+		last       fsnotify.Event // Most recent event of the burst
+		lastHot    string         // Hot-swap kind if the burst only touched the file in last, "" otherwise
+	)
+
+	// Atomic save state: editors that save by moving the old file aside, or
+	// renaming a temporary file over it, make a saved file vanish and come
+	// straight back. Files that vanished recently are remembered so their
+	// return counts as a write, not a new file, and the burst is held until
+	// the save has settled so it reloads once.
+	saves := newSaveState()
+	var saveSettles time.Time
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	// Rate limit state: reloads that come too soon after the previous one are
+	// held back and coalesced into a single reload once the interval has passed.
+	var (
+		gate       *time.Timer
+		gateC      <-chan time.Time
+		lastReload time.Time
+		held       fsnotify.Event // Latest reload waiting for the gate
+		heldHot    string         // Hot-swap kind if every held reload was for the file in held, "" otherwise
+	)
+	defer func() {
+		if gate != nil {
+			gate.Stop()
+		}
+	}()
+
+	// Startup grace state: for -startup-grace after starting, reloads are held
+	// so a build still writing its first output doesn't reload a half-built
+	// page. Whatever changed meanwhile is sent as one reload when it ends.
+	var (
+		graceC    <-chan time.Time
+		graceHeld fsnotify.Event // Latest reload held during the grace period
+		graced    bool           // Whether any reload was held
+	)
+	if cfg.StartupGrace > 0 {
+		grace := time.NewTimer(cfg.StartupGrace)
+		defer grace.Stop()
+		graceC = grace.C
+	}
+
+	// send broadcasts a single reload for every event accepted since the last
+	// one, so a tree-wide churn like npm install costs one pass over the clients.
+	// The paths those events touched decide which subscribed clients hear it,
+	// and any one of them calling for a hard reload makes the whole reload hard.
+	coalesced := 0
+	touched := make(map[string]bool)
+	hard := false
+	send := func(event fsnotify.Event, hot string) {
+		// Build first; events caused by the command queue up until it's done
+		if cfg.Exec != "" && !runExec(ctx, cfg, event) {
+			coalesced = 0
+			clear(touched)
+			hard = false
+			return
+		}
+		var paths []string
+		if len(touched) <= maxTouchedPaths {
+			for path := range touched {
+				paths = append(paths, path)
+			}
+			slices.Sort(paths)
+		}
+		if cfg.Verbose {
+			switch {
+			case len(touched) > maxTouchedPaths:
+				logAt(slog.LevelDebug, nil, "Reloading after %d coalesced event(s) touching more than %d paths\n", coalesced, maxTouchedPaths)
+			case len(paths) > 0:
+				logAt(slog.LevelDebug, nil, "Reloading after %d coalesced event(s) touching %s\n", coalesced, strings.Join(paths, ", "))
+			default:
+				logAt(slog.LevelDebug, nil, "Reloading after %d coalesced event(s)\n", coalesced)
+			}
+		}
+		count := coalesced
+		coalesced = 0
+		clear(touched)
+		lastReload = time.Now()
+		kind := "reload"
+		if hard {
+			kind = "hard-reload"
+		} else if hot != "" {
+			kind = hot
+		} else if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+			// Tell JSON clients why the page may come back broken
+			kind = "deleted"
+		}
+		hard = false
+		broadcastReload(cfg, event, kind, paths, count)
+	}
+	reload := func(event fsnotify.Event, hot string) {
+		if hashes != nil {
+			changed := forced
+			for _, e := range edited {
+				// Hash every file, even after a change is found, to keep the baseline current
+				changed = contentChanged(hashes, e) || changed
+			}
+			clear(edited)
+			forced = false
+			if !changed {
+				logDecision(cfg, event, "no reload, content unchanged")
+				if gateC == nil && graceC == nil {
+					coalesced = 0
+					clear(touched)
+					hard = false
+				}
+				return
+			}
+		}
+		if graceC != nil {
+			// Keep coalescing until the grace period ends, which sends one reload
+			logDecision(cfg, event, "reload held, within -startup-grace")
+			graceHeld, graced = event, true
+			return
+		}
+		if wait := cfg.MinReloadInterval - time.Since(lastReload); wait > 0 {
+			if gateC != nil && (hot != heldHot || held.Name != event.Name) {
+				hot = ""
+			}
+			held, heldHot = event, hot
+			if gateC == nil {
+				gate = time.NewTimer(wait)
+				gateC = gate.C
+			}
+			return
+		}
+		send(event, hot)
+	}
+
+	// Listen for file change events and errors
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				errorf("Error: the file watcher stopped unexpectedly, restarting it")
+				if !restartWatcher() {
+					return
+				}
+				// Changes made while no watcher was running went unseen
+				forced = true
+				reload(fsnotify.Event{}, "")
+				continue
+			}
+			if event.Name == "" {
+				continue // Self-event from a watch that was just removed
+			}
+			if cfg.probes != nil && isProbe(event.Name) {
+				select {
+				case cfg.probes <- event.Name:
+				default:
+				}
+				continue
+			}
+			cfg.fileEvents.Add(1)
+			debugPathf(cfg, event.Name, "Detected change: %v", event)
+			// Pick up edits to the ignore file without a restart
+			if isIgnoreFile(cfg, event.Name) {
+				if err := loadIgnoreFiles(cfg); err != nil {
+					warnf("Failed to reload ignore file: %v", err)
+				} else {
+					debugPathf(cfg, event.Name, "Reloaded ignore file %s\n", event.Name)
+				}
+			}
+			info, err := os.Stat(event.Name)
+			isDir := err == nil && info.IsDir() || watched[filepath.Clean(event.Name)]
+			if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+				removeDir(filepath.Clean(event.Name))
+				// A single file is only lost along with its directory; on its
+				// own it comes back through a Create in that directory
+				for _, root := range cfg.WatchDirs {
+					if rootDir(cfg, root) == filepath.Clean(event.Name) && !lost[root] {
+						infof(cfg, "Watch directory %s was removed, waiting for it to come back", rootDir(cfg, root))
+						lost[root] = true
+						go waitForRoot(root)
+					}
+				}
+			}
+			saving := false
+			if !isDir {
+				op := event.Op
+				event, saving = atomicSave(saves, event, err == nil, time.Now())
+				if event.Op != op {
+					debugPathf(cfg, event.Name, "Treating %s of %s as a write from an atomic save\n", opName(op), event.Name)
+				}
+			}
+			if !inWatchRoot(cfg, event.Name) {
+				logDecision(cfg, event, "ignored, not the watched file")
+				continue
+			}
+			// Files named on their own, with -watch-file or as a -watch root,
+			// were asked for explicitly, so no filter applies
+			name := filepath.Clean(event.Name)
+			explicit := cfg.watchFiles[name] || cfg.fileRoots[name]
+			if reason := ignoreReason(cfg, event.Name, isDir); reason != "" && !explicit {
+				logDecision(cfg, event, "ignored, "+reason)
+				continue
+			}
+			// Start watching directories created after startup, including
+			// anything already inside them by the time we get here
+			if event.Has(fsnotify.Create) && isDir {
+				if err := addDir(event.Name); err != nil {
+					warnf("Failed to watch new directory %s: %v", event.Name, err)
+				}
+			}
+			if event.Op&cfg.ops == 0 {
+				logDecision(cfg, event, "ignored, "+opName(event.Op)+" not in -watch-ops")
+				continue
+			}
+			if !hasWatchedExt(cfg, event.Name) && !explicit {
+				logDecision(cfg, event, "ignored, extension not in -ext")
+				continue
+			}
+			if hashes != nil {
+				if isDir {
+					forced = true
+				} else {
+					edited[event.Name] = event
+				}
+			}
+			logDecision(cfg, event, "reload scheduled")
+			coalesced++
+			if len(touched) <= maxTouchedPaths {
+				_, rel := relPath(cfg, event.Name)
+				touched[filepath.ToSlash(rel)] = true
+			}
+			hard = hard || isHardReload(cfg, event)
+			// A burst can only be applied as a hot swap if it touched nothing
+			// but a single stylesheet or module
+			hot := hotSwap(cfg, event)
+			if timerC != nil && (hot != lastHot || last.Name != event.Name) {
+				hot = ""
+			}
+			last, lastHot = event, hot
+			// Give a file that vanished a moment to come back and be written,
+			// so an atomic save reloads once even without debouncing
+			if saving {
+				saveSettles = time.Now().Add(atomicSaveWindow)
+			}
+			wait := max(cfg.Debounce, time.Until(saveSettles))
+			if wait <= 0 && timerC == nil {
+				reload(last, lastHot)
+				continue
+			}
+			if timerC == nil {
+				burstStart = time.Now()
+				timer = time.NewTimer(wait)
+				timerC = timer.C
+				continue
+			}
+			if remaining := cfg.DebounceMax - time.Since(burstStart); cfg.DebounceMax > 0 && remaining < wait {
+				wait = max(remaining, 0)
+			}
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(wait)
+		case <-timerC:
+			timerC = nil
+			reload(last, lastHot)
+		case <-graceC:
+			graceC = nil
+			if !graced {
+				infof(cfg, "Startup grace period of %s is over, reloading on changes", cfg.StartupGrace)
+				continue
+			}
+			infof(cfg, "Startup grace period of %s is over, sending the reload held during it", cfg.StartupGrace)
+			// The held changes already passed any hash check
+			forced = true
+			reload(graceHeld, "")
+		case <-gateC:
+			gateC = nil
+			send(held, heldHot)
+		case root := <-recovered:
+			delete(lost, root)
+			if err := addRoot(root); err != nil {
+				errorf("Failed to watch %s again: %v", root, err)
+				lost[root] = true
+				go waitForRoot(root)
+				continue
+			}
+			infof(cfg, "Watch directory %s is back, watching it again", root)
+			// Whatever was written while it was gone went unseen, so reload
+			forced = true
+			reload(fsnotify.Event{Name: root, Op: fsnotify.Create}, "")
+		case err, ok := <-errs:
+			if !ok {
+				errorf("Error: the file watcher's error channel closed unexpectedly, restarting it")
+				if !restartWatcher() {
+					return
+				}
+				forced = true
+				reload(fsnotify.Event{}, "")
+				continue
+			}
+			errorf("Watcher error: %v", err)
+		}
+	}
+}
+
+// walkWorkers bounds the goroutines listing directories while a tree is
+// added to the watcher. Walking is mostly waiting on the filesystem, so a
+// few more than the usual core count pay off on large trees.
+const walkWorkers = 16
+
+// atomicSaveWindow is how soon a file that vanished must come back for it to
+// count as saved rather than deleted and recreated. Editors saving atomically
+// put the new file in place within a few milliseconds.
+const atomicSaveWindow = 100 * time.Millisecond
+
+// saveState remembers what atomicSave needs to recognize the later steps
+// of an atomic save.
+type saveState struct {
+	vanished  map[string]time.Time // When each file was removed or renamed away
+	movedFrom map[string]time.Time // When a file was last renamed away from each directory
+}
+
+// newSaveState returns an empty saveState.
+func newSaveState() *saveState {
+	return &saveState{vanished: make(map[string]time.Time), movedFrom: make(map[string]time.Time)}
+}
+
+// atomicSave rewrites the events of an atomic save onto a file as writes and
+// reports whether event is part of a save still in progress, whose reload
+// should wait for the rest. A remove or rename makes the file vanish; if it
+// exists again by the time the event is seen, it was already replaced and
+// the event is a write. A create within atomicSaveWindow of now is a write
+// too if the file vanished, or if another file in its directory was renamed
+// away: that is a temporary file being renamed over it. Other events are
+// returned unchanged.
+func atomicSave(s *saveState, event fsnotify.Event, exists bool, now time.Time) (fsnotify.Event, bool) {
+	name := filepath.Clean(event.Name)
+	switch {
+	case event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename):
+		s.forget(now)
+		s.vanished[name] = now
+		if event.Has(fsnotify.Rename) {
+			s.movedFrom[filepath.Dir(name)] = now
+		}
+		if exists {
+			event.Op = fsnotify.Write
+		}
+		return event, true
+	case event.Has(fsnotify.Create):
+		at, vanished := s.vanished[name]
+		delete(s.vanished, name)
+		if !vanished {
+			at, vanished = s.movedFrom[filepath.Dir(name)]
+		}
+		if vanished && now.Sub(at) <= atomicSaveWindow {
+			event.Op = fsnotify.Write
+			return event, true
+		}
+	}
+	return event, false
+}
+
+// forget drops entries older than atomicSaveWindow, which can no longer
+// match, so the maps stay small.
+func (s *saveState) forget(now time.Time) {
+	for _, m := range []map[string]time.Time{s.vanished, s.movedFrom} {
+		for key, at := range m {
+			if now.Sub(at) > atomicSaveWindow {
+				delete(m, key)
+			}
+		}
+	}
+}
+
+// Bounds on how often a removed watch root is checked for.
+const (
+	rootRetryMin = 100 * time.Millisecond
+	rootRetryMax = 5 * time.Second
+)
+
+// Bounds on how quickly a watcher that died is recreated.
+const (
+	restartMin = 500 * time.Millisecond
+	restartMax = 30 * time.Second
+)
+
+// defaultWatchOps are the operations that trigger reloads when -watch-ops is
+// empty. Chmod is left out since attribute changes, frequent on macOS, don't
+// change what the browser would load.
+const defaultWatchOps = fsnotify.Write | fsnotify.Create | fsnotify.Remove | fsnotify.Rename
+
+// parseOps turns -watch-ops names such as "write" or "chmod" into an
+// operation mask, defaultWatchOps if names is empty.
+func parseOps(names []string) (fsnotify.Op, error) {
+	var ops fsnotify.Op
+	for _, name := range names {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "write":
+			ops |= fsnotify.Write
+		case "create":
+			ops |= fsnotify.Create
+		case "remove":
+			ops |= fsnotify.Remove
+		case "rename":
+			ops |= fsnotify.Rename
+		case "chmod":
+			ops |= fsnotify.Chmod
+		case "":
+		default:
+			return 0, fmt.Errorf("invalid watch operation %q: it must be write, create, remove, rename or chmod", name)
+		}
+	}
+	if ops == 0 {
+		ops = defaultWatchOps
+	}
+	return ops, nil
+}
+
+// watchRoot returns the watch root that path names, or "" if it isn't one.
+func watchRoot(cfg *serverConfig, path string) string {
+	for _, root := range cfg.WatchDirs {
+		if filepath.Clean(root) == filepath.Clean(path) {
+			return root
+		}
+	}
+	return ""
+}
+
+// isFileRoot reports whether root is a -watch entry naming a single file.
+func isFileRoot(cfg *serverConfig, root string) bool {
+	return cfg.fileRoots[filepath.Clean(root)]
+}
+
+// rootDir returns the directory watched for root: root itself, or its parent
+// when it names a single file.
+func rootDir(cfg *serverConfig, root string) string {
+	if isFileRoot(cfg, root) {
+		return filepath.Dir(filepath.Clean(root))
+	}
+	return filepath.Clean(root)
+}
+
+// inWatchRoot reports whether path is a single-file watch root or lies within
+// a directory root. Only events for the siblings of a watched file fall
+// outside every root.
+func inWatchRoot(cfg *serverConfig, path string) bool {
+	if len(cfg.fileRoots) == 0 {
+		return true
+	}
+	path = filepath.Clean(path)
+	for _, root := range cfg.WatchDirs {
+		if isFileRoot(cfg, root) {
+			if filepath.Clean(root) == path {
+				return true
+			}
+			continue
+		}
+		if r, err := filepath.Rel(root, path); err == nil && r != ".." && !strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxTouchedPaths is how many changed paths a reload tracks for subscribed
+// clients; a reload touching more than that goes to every client.
+const maxTouchedPaths = 256
+
+// hashMaxSize is the largest file -hash-check will hash; bigger files always reload.
+const hashMaxSize = 8 << 20
+
+// contentChanged reports whether event's file differs from the content hash
+// recorded for it in hashes, and records the new hash. A file with no hash
+// yet is new since startup and counts as changed. Removed files are
+// forgotten, and files that can't be hashed, or are larger than hashMaxSize,
+// always count as changed.
+func contentChanged(hashes map[string]uint64, event fsnotify.Event) bool {
+	if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+		delete(hashes, event.Name)
+		return true
+	}
+	sum, ok := hashFile(event.Name)
+	if !ok {
+		delete(hashes, event.Name)
+		return true
+	}
+	old, seen := hashes[event.Name]
+	hashes[event.Name] = sum
+	return !seen || old != sum
+}
+
+// hashFile returns the FNV-1a hash of the file at path, or false if it can't
+// be read or is larger than hashMaxSize.
+func hashFile(path string) (uint64, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || info.Size() > hashMaxSize {
+		return 0, false
+	}
+	h := fnv.New64a()
+	if _, err := io.Copy(h, f); err != nil {
+		return 0, false
+	}
+	return h.Sum64(), true
+}
+
+// dirDepth returns how many levels dir is below its watch root, 0 for the
+// root itself.
+func dirDepth(cfg *serverConfig, dir string) int {
+	_, rel := relPath(cfg, filepath.Clean(dir))
+	if rel == "." {
+		return 0
+	}
+	return strings.Count(rel, string(filepath.Separator)) + 1
+}
+
+// relPath returns the watch directory containing path and path relative to it.
+// When roots are nested the deepest one wins; a path outside every root is
+// returned unchanged alongside the first root. A single-file root counts as
+// its parent directory, so the file's rel is its base name.
+func relPath(cfg *serverConfig, path string) (root, rel string) {
+	root, rel = cfg.WatchDirs[0], path
+	found := false
+	for _, dir := range cfg.WatchDirs {
+		r, err := filepath.Rel(rootDir(cfg, dir), path)
+		if err != nil || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if !found || len(r) < len(rel) {
+			root, rel, found = dir, r, true
+		}
+	}
+	return root, rel
+}
@@ -0,0 +1,527 @@
+package livereload
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/gorilla/websocket"
+)
+
+func TestAtomicSave(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		vanished  map[string]time.Time // Files that went away before the event
+		movedFrom map[string]time.Time // Directories a file was renamed away from
+		event     fsnotify.Event
+		exists    bool
+		wantOp    fsnotify.Op
+		saving    bool
+	}{
+		{"plain write", nil, nil, fsnotify.Event{Name: "a.js", Op: fsnotify.Write}, true, fsnotify.Write, false},
+		{"new file", nil, nil, fsnotify.Event{Name: "a.js", Op: fsnotify.Create}, true, fsnotify.Create, false},
+		{"moved aside", nil, nil, fsnotify.Event{Name: "a.js", Op: fsnotify.Rename}, false, fsnotify.Rename, true},
+		{"deleted", nil, nil, fsnotify.Event{Name: "a.js", Op: fsnotify.Remove}, false, fsnotify.Remove, true},
+		{"already replaced", nil, nil, fsnotify.Event{Name: "a.js", Op: fsnotify.Rename}, true, fsnotify.Write, true},
+		{"back after rename", map[string]time.Time{"a.js": now.Add(-10 * time.Millisecond)}, nil,
+			fsnotify.Event{Name: "a.js", Op: fsnotify.Create}, true, fsnotify.Write, true},
+		{"back too late", map[string]time.Time{"a.js": now.Add(-time.Second)}, nil,
+			fsnotify.Event{Name: "a.js", Op: fsnotify.Create}, true, fsnotify.Create, false},
+		{"other file back", map[string]time.Time{"b.js": now}, nil,
+			fsnotify.Event{Name: "a.js", Op: fsnotify.Create}, true, fsnotify.Create, false},
+		{"temp renamed over it", nil, map[string]time.Time{"src": now},
+			fsnotify.Event{Name: "src/a.js", Op: fsnotify.Create}, true, fsnotify.Write, true},
+		{"rename in another directory", nil, map[string]time.Time{"lib": now},
+			fsnotify.Event{Name: "src/a.js", Op: fsnotify.Create}, true, fsnotify.Create, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSaveState()
+			for name, at := range tt.vanished {
+				s.vanished[name] = at
+			}
+			for dir, at := range tt.movedFrom {
+				s.movedFrom[dir] = at
+			}
+			got, saving := atomicSave(s, tt.event, tt.exists, now)
+			if got.Op != tt.wantOp || saving != tt.saving {
+				t.Errorf("atomicSave(%v) = %v, %t; want %v, %t", tt.event, got.Op, saving, tt.wantOp, tt.saving)
+			}
+		})
+	}
+}
+
+func TestAtomicSaveSequence(t *testing.T) {
+	s := newSaveState()
+	now := time.Now()
+	// Writing a temporary file and renaming it over the target
+	steps := []struct {
+		event  fsnotify.Event
+		exists bool
+		want   fsnotify.Op
+	}{
+		{fsnotify.Event{Name: "src/a.js.tmp", Op: fsnotify.Create}, true, fsnotify.Create},
+		{fsnotify.Event{Name: "src/a.js.tmp", Op: fsnotify.Write}, true, fsnotify.Write},
+		{fsnotify.Event{Name: "src/a.js.tmp", Op: fsnotify.Rename}, false, fsnotify.Rename},
+		{fsnotify.Event{Name: "src/a.js", Op: fsnotify.Create}, true, fsnotify.Write},
+	}
+	for _, step := range steps {
+		if got, _ := atomicSave(s, step.event, step.exists, now); got.Op != step.want {
+			t.Errorf("%v became %v, want %v", step.event, got.Op, step.want)
+		}
+	}
+	// Long after, a new file is just a new file
+	later := now.Add(time.Second)
+	atomicSave(s, fsnotify.Event{Name: "src/old.js", Op: fsnotify.Remove}, false, later)
+	if len(s.vanished) != 1 || len(s.movedFrom) != 0 {
+		t.Errorf("stale entries kept: vanished %v, moved from %v", s.vanished, s.movedFrom)
+	}
+}
+
+// countReloads reads messages from conn for d and returns how many arrived.
+func countReloads(t *testing.T, conn *websocket.Conn, d time.Duration) int {
+	t.Helper()
+	n := 0
+	conn.SetReadDeadline(time.Now().Add(d))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return n
+		}
+		n++
+	}
+}
+
+func TestAtomicSaveReloadsOnce(t *testing.T) {
+	saves := map[string]func(t *testing.T, dir string){
+		"write temp then rename": func(t *testing.T, dir string) {
+			tmp := filepath.Join(dir, "a.js.tmp")
+			writeFile(t, tmp, "new")
+			if err := os.Rename(tmp, filepath.Join(dir, "a.js")); err != nil {
+				t.Fatal(err)
+			}
+		},
+		"move aside then write": func(t *testing.T, dir string) {
+			target := filepath.Join(dir, "a.js")
+			if err := os.Rename(target, target+"~"); err != nil {
+				t.Fatal(err)
+			}
+			writeFile(t, target, "new")
+			os.Remove(target + "~")
+		},
+	}
+	for name, save := range saves {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFile(t, filepath.Join(dir, "a.js"), "old")
+			_, conn := startTestServer(t, Config{WatchDirs: []string{dir}})
+			save(t, dir)
+			if n := countReloads(t, conn, 500*time.Millisecond); n != 1 {
+				t.Errorf("got %d reloads, want 1", n)
+			}
+		})
+	}
+}
+
+func TestAtomicSaveWithWriteOnly(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.js"), "old")
+	_, conn := startTestServer(t, Config{WatchDirs: []string{dir}, WatchOps: []string{"write"}})
+	tmp := filepath.Join(dir, "a.js.tmp")
+	writeFile(t, tmp, "new")
+	if err := os.Rename(tmp, filepath.Join(dir, "a.js")); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, conn, "reload")
+}
+
+// makeTree creates fanout subdirectories in root, and as many in each of
+// those, depth levels deep, and returns the deepest directories.
+func makeTree(tb testing.TB, root string, depth, fanout int) []string {
+	tb.Helper()
+	level := []string{root}
+	for d := 0; d < depth; d++ {
+		var next []string
+		for _, dir := range level {
+			for i := 0; i < fanout; i++ {
+				sub := filepath.Join(dir, fmt.Sprintf("d%d", i))
+				if err := os.Mkdir(sub, 0o755); err != nil {
+					tb.Fatal(err)
+				}
+				next = append(next, sub)
+			}
+		}
+		level = next
+	}
+	return level
+}
+
+func BenchmarkStartup(b *testing.B) {
+	root := b.TempDir()
+	makeTree(b, root, 4, 6) // 1554 directories
+	cfg := Config{Host: "127.0.0.1", Port: "0", WatchDirs: []string{root}, LogLevel: "error"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		srv := New(cfg)
+		if err := srv.Start(context.Background()); err != nil {
+			b.Fatalf("Start: %v", err)
+		}
+		srv.Shutdown(context.Background())
+	}
+}
+
+// TestConcurrentWalk has the initial walk's goroutines share the watched set,
+// the resolved-directory map of -follow-symlinks and the .gitignore rules;
+// run it with -race.
+func TestConcurrentWalk(t *testing.T) {
+	root := t.TempDir()
+	leaves := makeTree(t, root, 3, 6)
+	for _, leaf := range leaves {
+		writeFile(t, filepath.Join(leaf, ".gitignore"), "build/\n")
+		if err := os.Mkdir(filepath.Join(leaf, "build"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A link back to the root must be recognized as already watched
+	if err := os.Symlink(root, filepath.Join(leaves[0], "loop")); err != nil {
+		t.Fatal(err)
+	}
+	_, conn := startTestServer(t, Config{
+		WatchDirs:      []string{root},
+		UseGitignore:   true,
+		FollowSymlinks: true,
+		Debounce:       50 * time.Millisecond, // One reload per create-and-write
+	})
+
+	for _, leaf := range []string{leaves[0], leaves[len(leaves)/2], leaves[len(leaves)-1]} {
+		writeFile(t, filepath.Join(leaf, "app.js"), "x")
+		expectMessage(t, conn, "reload")
+	}
+	writeFile(t, filepath.Join(leaves[len(leaves)-1], "build", "out.js"), "ignored")
+	expectNoMessage(t, conn, 300*time.Millisecond)
+}
+
+func TestSingleFileRoot(t *testing.T) {
+	// start watches dir/bundle.js alone, with a sibling beside it
+	start := func(t *testing.T) (string, *websocket.Conn) {
+		dir := t.TempDir()
+		file := filepath.Join(dir, "bundle.js")
+		writeFile(t, file, "v1")
+		writeFile(t, filepath.Join(dir, "other.js"), "v1")
+		_, conn := startTestServer(t, Config{WatchDirs: []string{file}})
+		return file, conn
+	}
+
+	t.Run("write to the file", func(t *testing.T) {
+		file, conn := start(t)
+		writeFile(t, file, "v2")
+		expectMessage(t, conn, "reload")
+	})
+	t.Run("write to a sibling", func(t *testing.T) {
+		file, conn := start(t)
+		writeFile(t, filepath.Join(filepath.Dir(file), "other.js"), "v2")
+		writeFile(t, filepath.Join(filepath.Dir(file), "new.js"), "v1")
+		expectNoMessage(t, conn, 300*time.Millisecond)
+	})
+	t.Run("rename and recreate", func(t *testing.T) {
+		file, conn := start(t)
+		if err := os.Rename(file, file+".old"); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, file, "v2")
+		expectMessage(t, conn, "reload")
+	})
+}
+
+func TestSingleFileRootSkipsFilters(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "bundle.js")
+	writeFile(t, file, "v1")
+	// Each of these would drop bundle.js if it weren't named on its own
+	_, conn := startTestServer(t, Config{
+		WatchDirs:  []string{file},
+		Extensions: []string{"css"},
+		Ignore:     []string{"*.js"},
+		Only:       []string{"src/**"},
+	})
+	writeFile(t, file, "v2")
+	expectMessage(t, conn, "reload")
+}
+
+func TestWatchFileOutsideRoot(t *testing.T) {
+	project, shared := t.TempDir(), t.TempDir()
+	rc := filepath.Join(shared, ".myrc")
+	writeFile(t, rc, "a=1")
+	// The extension filter and -skip-hidden don't apply to -watch-file entries
+	_, conn := startTestServer(t, Config{
+		WatchDirs:  []string{project},
+		WatchFiles: []string{rc},
+		Extensions: []string{"js"},
+		SkipHidden: true,
+	})
+	writeFile(t, rc, "a=2")
+	expectMessage(t, conn, "reload")
+}
+
+func TestWatchNewNestedDirectory(t *testing.T) {
+	srv, conn := startTestServer(t, Config{Debounce: 50 * time.Millisecond})
+	deep := filepath.Join(testWatchDir(srv), "a", "b", "c")
+	if err := os.MkdirAll(deep, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, conn, "reload")
+	writeFile(t, filepath.Join(deep, "app.js"), "x")
+	expectMessage(t, conn, "reload")
+}
+
+func TestRenamedDirectoryStaysWatched(t *testing.T) {
+	dir := t.TempDir()
+	old := filepath.Join(dir, "components", "button")
+	if err := os.MkdirAll(old, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(old, "button.js"), "v1")
+	_, conn := startTestServer(t, Config{WatchDirs: []string{dir}, Debounce: 50 * time.Millisecond})
+
+	renamed := filepath.Join(dir, "widgets")
+	if err := os.Rename(filepath.Join(dir, "components"), renamed); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, conn, "reload")
+	writeFile(t, filepath.Join(renamed, "button", "button.js"), "v2")
+	expectMessage(t, conn, "reload")
+}
+
+func TestMinReloadInterval(t *testing.T) {
+	const interval, flood = 200 * time.Millisecond, time.Second
+	srv, conn := startTestServer(t, Config{MinReloadInterval: interval})
+	file := filepath.Join(testWatchDir(srv), "app.js")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for end := time.Now().Add(flood); time.Now().Before(end); time.Sleep(5 * time.Millisecond) {
+			os.WriteFile(file, []byte(time.Now().String()), 0o644)
+		}
+	}()
+	// The flood plus the reload held back for its last writes
+	n := countReloads(t, conn, flood+2*interval)
+	<-done
+	if limit := int(flood/interval) + 2; n < 2 || n > limit {
+		t.Errorf("got %d reloads from a %s flood, want between 2 and %d", n, flood, limit)
+	}
+}
+
+func TestSkipHidden(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{".git", "src"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv, conn := startTestServer(t, Config{WatchDirs: []string{dir}, SkipHidden: true, Debounce: 50 * time.Millisecond})
+
+	cfg := &srv.cfg
+	if !shouldIgnore(cfg, filepath.Join(dir, ".git"), true) || !shouldIgnore(cfg, filepath.Join(dir, "src", ".env"), false) {
+		t.Error("hidden paths not ignored")
+	}
+	if shouldIgnore(cfg, filepath.Join(dir, "src", "file.js"), false) {
+		t.Error("src/file.js ignored")
+	}
+
+	writeFile(t, filepath.Join(dir, "src", "file.js"), "x")
+	expectMessage(t, conn, "reload")
+	writeFile(t, filepath.Join(dir, ".git", "index"), "x")
+	writeFile(t, filepath.Join(dir, ".eslintrc"), "x")
+	expectNoMessage(t, conn, 300*time.Millisecond)
+}
+
+func TestRootRecreated(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "dist")
+	if err := os.Mkdir(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	_, conn := startTestServer(t, Config{WatchDirs: []string{root}, JSONMessages: true, Debounce: 50 * time.Millisecond})
+
+	// A build wiping and rewriting its output directory
+	if err := os.RemoveAll(root); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := os.Mkdir(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// The root is polled for from rootRetryMin, so keep writing until a
+	// write is seen
+	msgs := make(chan reloadMessage, 16)
+	go func() {
+		for {
+			var msg reloadMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				close(msgs)
+				return
+			}
+			msgs <- msg
+		}
+	}()
+	file := filepath.Join(root, "index.html")
+	deadline := time.After(testTimeout)
+	retry := time.NewTicker(2 * rootRetryMin)
+	defer retry.Stop()
+	for i := 0; ; i++ {
+		writeFile(t, file, fmt.Sprint(i))
+	wait:
+		for {
+			select {
+			case msg, ok := <-msgs:
+				if !ok {
+					t.Fatal("connection closed")
+				}
+				if msg.Path == "index.html" {
+					return
+				}
+			case <-retry.C:
+				break wait
+			case <-deadline:
+				t.Fatal("writes in the recreated root never reloaded")
+			}
+		}
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	dir := t.TempDir()
+	deep := filepath.Join(dir, "a", "b")
+	if err := os.MkdirAll(deep, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// The root and one level below it, as -max-depth 1 on the command line
+	srv, conn := startTestServer(t, Config{WatchDirs: []string{dir}, MaxDepth: 2, Debounce: 50 * time.Millisecond})
+	if got := dirDepth(&srv.cfg, deep); got != 2 {
+		t.Fatalf("dirDepth(a/b) = %d, want 2", got)
+	}
+
+	writeFile(t, filepath.Join(dir, "root.js"), "x")
+	expectMessage(t, conn, "reload")
+	writeFile(t, filepath.Join(dir, "a", "level1.js"), "x")
+	expectMessage(t, conn, "reload")
+	writeFile(t, filepath.Join(deep, "level2.js"), "x")
+	expectNoMessage(t, conn, 300*time.Millisecond)
+}
+
+func TestChmod(t *testing.T) {
+	// start watches a directory holding app.js with the given -watch-ops
+	start := func(t *testing.T, ops []string) (string, *websocket.Conn) {
+		dir := t.TempDir()
+		file := filepath.Join(dir, "app.js")
+		writeFile(t, file, "x")
+		_, conn := startTestServer(t, Config{WatchDirs: []string{dir}, WatchOps: ops})
+		return file, conn
+	}
+
+	t.Run("ignored by default", func(t *testing.T) {
+		file, conn := start(t, nil)
+		if err := os.Chmod(file, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		expectNoMessage(t, conn, 300*time.Millisecond)
+	})
+	t.Run("reloads when listed", func(t *testing.T) {
+		file, conn := start(t, []string{"write", "chmod"})
+		if err := os.Chmod(file, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		expectMessage(t, conn, "reload")
+	})
+}
+
+func TestFollowSymlinks(t *testing.T) {
+	// project/shared links to a sibling of the project, which links back
+	// to the project to make a cycle
+	base := t.TempDir()
+	project, lib := filepath.Join(base, "project"), filepath.Join(base, "lib")
+	for _, dir := range []string{project, lib} {
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(lib, filepath.Join(project, "shared")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(project, filepath.Join(lib, "back")); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("followed", func(t *testing.T) {
+		// Start only returns once the walk is done, so getting past it
+		// shows the cycle through lib/back was cut
+		_, conn := startTestServer(t, Config{WatchDirs: []string{project}, FollowSymlinks: true})
+		writeFile(t, filepath.Join(lib, "util.js"), "x")
+		expectMessage(t, conn, "reload")
+	})
+	t.Run("not followed by default", func(t *testing.T) {
+		_, conn := startTestServer(t, Config{WatchDirs: []string{project}})
+		writeFile(t, filepath.Join(lib, "util.js"), "y")
+		expectNoMessage(t, conn, 300*time.Millisecond)
+	})
+}
+
+func TestOnly(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"src", "docs"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv, conn := startTestServer(t, Config{WatchDirs: []string{dir}, Only: []string{"src/**", "*.html"}, Debounce: 50 * time.Millisecond})
+
+	cfg := &srv.cfg
+	for rel, want := range map[string]bool{
+		"src/app.js":      true,
+		"index.html":      true,
+		"docs/guide.html": true,
+		"docs/notes.md":   false,
+		"README.md":       false,
+	} {
+		if got := !shouldIgnore(cfg, filepath.Join(dir, filepath.FromSlash(rel)), false); got != want {
+			t.Errorf("%s allowed = %v, want %v", rel, got, want)
+		}
+	}
+
+	writeFile(t, filepath.Join(dir, "src", "app.js"), "x")
+	expectMessage(t, conn, "reload")
+	writeFile(t, filepath.Join(dir, "docs", "guide.html"), "x")
+	expectMessage(t, conn, "reload")
+	writeFile(t, filepath.Join(dir, "docs", "notes.md"), "x")
+	writeFile(t, filepath.Join(dir, "README.md"), "x")
+	expectNoMessage(t, conn, 300*time.Millisecond)
+}
+
+func TestHashCheckIgnoresTouch(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.js"), "a")
+	writeFile(t, filepath.Join(dir, "b.js"), "b")
+	_, conn := startTestServer(t, Config{
+		WatchDirs:    []string{dir},
+		HashCheck:    true,
+		JSONMessages: true,
+		Debounce:     50 * time.Millisecond,
+	})
+	// The first write to a.js after startup leaves its content as it was, so
+	// the first reload must be the one for b.js
+	writeFile(t, filepath.Join(dir, "a.js"), "a")
+	time.Sleep(300 * time.Millisecond)
+	writeFile(t, filepath.Join(dir, "b.js"), "changed")
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	var msg reloadMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(msg.Files, []string{"b.js"}) {
+		t.Fatalf("first reload was for %q, want [b.js]", msg.Files)
+	}
+}
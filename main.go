@@ -2,29 +2,39 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"net/http"
+	"log/slog"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
-	"github.com/fsnotify/fsnotify"
-	"github.com/gorilla/websocket"
 	"github.com/joho/godotenv"
+	"github.com/nooooaaaaah/RefreshMeDaddy/livereload"
 )
 
-// serverConfig holds the configuration for the server.
-type serverConfig struct {
-	port       string                                 // Port on which the server listens
-	watchDir   string                                 // Directory to watch for changes
-	verbose    bool                                   // Enable verbose logging
-	ignoreList stringSlice                            // List of paths to ignore
-	upgrader   websocket.Upgrader                     // Upgrader for websocket connections
-	clients    map[*websocket.Conn]context.CancelFunc // Active clients and their cancel funcs
+// selfTestTimeout is how long -self-test waits for the watcher at each step.
+const selfTestTimeout = 5 * time.Second
+
+// options holds the command-line settings: the server configuration plus the
+// flags that only make sense for the CLI.
+type options struct {
+	server          livereload.Config // Configuration passed to the server
+	maxReloadRate   reloadRate        // Upper bound on reload frequency
+	maxDepth        int               // Levels below each root to watch, negative for unlimited
+	mounts          stringSlice       // Further endpoints as path=dir entries
+	selfTest        bool              // Verify the watcher reports changes, then exit
+	configFile      string            // Path to an optional config file
+	printConfig     bool              // Print the resolved configuration and exit
+	printSnippet    bool              // Print the client snippet and exit
+	quiet           bool              // Only log errors and warnings, same as -log-level error
+	logJSON         bool              // Log JSON lines instead of plain text
+	shutdownTimeout time.Duration     // How long to wait for connections to close on shutdown
 }
 
 // stringSlice is a custom type that implements flag.Value interface for string slices.
@@ -35,197 +45,302 @@ func (i *stringSlice) String() string {
 	return fmt.Sprint(*i)
 }
 
-// Set splits a comma-separated string and appends it to the slice.
+// Set splits a comma-separated string and appends each entry to the slice,
+// so repeated flags accumulate. Whitespace around entries is trimmed and
+// empty entries are dropped.
 func (i *stringSlice) Set(value string) error {
 	for _, val := range strings.Split(value, ",") {
-		*i = append(*i, val)
+		if val = strings.TrimSpace(val); val != "" {
+			*i = append(*i, val)
+		}
 	}
 	return nil
 }
 
-// init attempts to load environment variables from a .env file.
-func init() {
-	if err := godotenv.Load(); err != nil {
-		log.Println("No .env file found")
-	}
+// reloadRate is a flag.Value for a maximum reload rate such as "1/s", "2/sec"
+// or "30/min", stored as the minimum interval between reloads.
+type reloadRate struct {
+	spec     string        // Rate as given on the command line
+	interval time.Duration // Minimum time between reloads, 0 for unlimited
 }
 
-// main sets up the server configuration, starts the file watcher and the web server.
-func main() {
-	// Configuration and flag parsing
-	var cfg serverConfig
-	// Server configuration flags
-	flag.StringVar(&cfg.port, "port", "8080", "port to run the WebSocket server on")
-	flag.StringVar(&cfg.port, "p", "8080", "port to run the WebSocket server on (shorthand)")
-	flag.StringVar(&cfg.watchDir, "watch", ".", "directory to watch for changes")
-	flag.StringVar(&cfg.watchDir, "w", ".", "directory to watch for changes (shorthand)")
-	flag.BoolVar(&cfg.verbose, "verbose", false, "enable verbose logging")
-	flag.BoolVar(&cfg.verbose, "v", false, "enable verbose logging (shorthand)")
-	flag.Var(&cfg.ignoreList, "ignore", "comma-separated list of directories or files to ignore")
-	flag.Var(&cfg.ignoreList, "i", "comma-separated list of directories or files to ignore (shorthand)")
-	flag.Parse()
+// String returns the rate as it was given.
+func (r *reloadRate) String() string {
+	return r.spec
+}
 
-	// Initialize clients map and upgrader configuration
-	cfg.clients = make(map[*websocket.Conn]context.CancelFunc)
-	cfg.upgrader = websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		// CheckOrigin verifies the origin of the request
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
+// Set parses a rate of the form <count>/<unit>, where unit is s, sec, m, min,
+// h or hour. An empty string or "0" removes the limit.
+func (r *reloadRate) Set(value string) error {
+	if value == "" || value == "0" {
+		*r = reloadRate{}
+		return nil
 	}
+	count, unit, ok := strings.Cut(value, "/")
+	n, err := strconv.ParseFloat(count, 64)
+	if !ok || err != nil || n <= 0 {
+		return fmt.Errorf("invalid rate %q, expected e.g. 1/s or 30/min", value)
+	}
+	var per time.Duration
+	switch unit {
+	case "s", "sec", "second":
+		per = time.Second
+	case "m", "min", "minute":
+		per = time.Minute
+	case "h", "hour":
+		per = time.Hour
+	default:
+		return fmt.Errorf("invalid rate unit %q, expected s, min or hour", unit)
+	}
+	*r = reloadRate{spec: value, interval: time.Duration(float64(per) / n)}
+	return nil
+}
 
-	// Setup signal handling for graceful shutdown
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
-	defer stop()
-
-	// WebSocket handler
-	http.HandleFunc("/refreshMeDaddy", func(w http.ResponseWriter, r *http.Request) {
-		serveWs(&cfg, w, r)
-	})
-	// Start watching files in a separate goroutine
-	go watchFiles(&cfg, ctx)
-
-	// Server startup logs
-	if cfg.verbose {
-		log.Printf("Verbose logging enabled\n")
-	}
-	log.Printf("Starting live-reload server on :%s\n", cfg.port)
-	server := &http.Server{Addr: ":" + cfg.port}
-	go func() {
-		if err := server.ListenAndServe(); err != http.ErrServerClosed {
-			log.Fatalf("ListenAndServe(): %v", err)
+// parseMounts turns -mount entries of the form path=dir into mounts, in the
+// order their paths first appear. Entries for the same path add directories
+// to one mount.
+func parseMounts(entries []string) ([]livereload.Mount, error) {
+	var mounts []livereload.Mount
+	index := map[string]int{}
+	for _, entry := range entries {
+		path, dir, ok := strings.Cut(entry, "=")
+		if !ok || path == "" || dir == "" {
+			return nil, fmt.Errorf("invalid -mount %q, expected path=dir, e.g. /reload/docs=docs", entry)
+		}
+		i, seen := index[path]
+		if !seen {
+			i = len(mounts)
+			index[path] = i
+			mounts = append(mounts, livereload.Mount{Path: path})
 		}
-	}()
+		mounts[i].WatchDirs = append(mounts[i].WatchDirs, dir)
+	}
+	return mounts, nil
+}
 
-	<-ctx.Done() // Wait for interrupt signal to gracefully shutdown
+// dotenvMissing records that init found no .env file, which is only
+// reported once the log level is known.
+var dotenvMissing bool
 
-	log.Println("Shutting down server...")
-	if err := server.Shutdown(context.Background()); err != nil {
-		log.Fatalf("Server Shutdown Failed:%+v", err)
-	}
-	log.Println("Server gracefully stopped")
+// init attempts to load environment variables from a .env file.
+func init() {
+	dotenvMissing = godotenv.Load() != nil
 }
 
-// serveWs handles incoming WebSocket connections.
-func serveWs(cfg *serverConfig, w http.ResponseWriter, r *http.Request) {
-	// Upgrade HTTP server connection to a WebSocket connection
-	conn, err := cfg.upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("WebSocket upgrade error: %v", err)
-		return
-	}
-	if cfg.verbose {
-		log.Println("WebSocket connection established")
-	}
-	ctx, cancel := context.WithCancel(context.Background())
-	cfg.clients[conn] = cancel
-
-	// Listen for messages on the WebSocket connection
-	go func() {
-		defer func() {
-			conn.Close()
-			delete(cfg.clients, conn)
-			cancel()
-			if cfg.verbose {
-				log.Println("WebSocket connection closed")
-			}
-		}()
+// main registers and parses the command-line flags, then hands over to run.
+func main() {
+	var opts options
+	defineFlags(&opts)
+	flag.Parse()
 
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				if _, _, err := conn.NextReader(); err != nil {
-					if cfg.verbose {
-						log.Printf("WebSocket read error: %v", err)
-					}
-					return
-				}
-			}
+	if err := run(&opts); err != nil {
+		if opts.logJSON {
+			slog.Error(err.Error())
+			os.Exit(1)
 		}
-	}()
+		log.Fatal(err)
+	}
+}
+
+// defineFlags registers every command-line flag on flag.CommandLine, bound to
+// the fields of opts.
+func defineFlags(opts *options) {
+	cfg := &opts.server
+	// Server configuration flags
+	flag.StringVar(&cfg.Host, "host", "", "host or IP address to listen on, e.g. localhost or ::1 (default: all interfaces)")
+	flag.StringVar(&cfg.Network, "network", "tcp", "listen network: tcp for dual-stack, tcp4 or tcp6")
+	flag.StringVar(&cfg.Port, "port", livereload.DefaultPort, "port to run the WebSocket server on")
+	flag.StringVar(&cfg.Port, "p", livereload.DefaultPort, "port to run the WebSocket server on (shorthand)")
+	flag.Var((*stringSlice)(&cfg.WatchDirs), "watch", "comma-separated or repeated directories or files to watch for changes (default \".\")")
+	flag.Var((*stringSlice)(&cfg.WatchDirs), "w", "comma-separated or repeated directories or files to watch for changes (shorthand)")
+	flag.Var((*stringSlice)(&cfg.WatchFiles), "watch-file", "comma-separated or repeated files anywhere on disk to also watch, e.g. ~/.myrc; -ignore and -ext don't apply to them")
+	flag.StringVar(&cfg.Path, "path", livereload.DefaultPath, "URL path of the WebSocket endpoint; the client script is served at <path>.js")
+	flag.Var(&opts.mounts, "mount", "comma-separated or repeated path=dir entries adding an endpoint that only reloads for changes in dir, e.g. /reload/docs=docs; repeat a path to watch several directories")
+	flag.StringVar(&cfg.BasePath, "base-path", "", "prefix for every route, e.g. /dev when served behind a reverse proxy under /dev/")
+	flag.StringVar(&cfg.LogLevel, "log-level", "info", "how much to log: error (errors and warnings only), info or debug")
+	flag.BoolVar(&cfg.Verbose, "verbose", false, "enable verbose logging, same as -log-level debug")
+	flag.BoolVar(&cfg.Verbose, "v", false, "enable verbose logging, same as -log-level debug (shorthand)")
+	flag.BoolVar(&opts.logJSON, "log-json", false, "log one JSON object per line with level, msg and, where relevant, conn_id and path fields")
+	flag.BoolVar(&opts.quiet, "quiet", false, "only log errors and warnings, same as -log-level error")
+	flag.BoolVar(&opts.quiet, "q", false, "only log errors and warnings, same as -log-level error (shorthand)")
+	flag.Var((*stringSlice)(&cfg.Only), "only", "comma-separated or repeated patterns of the only paths to watch, e.g. content,assets; -ignore still applies within them")
+	flag.Var((*stringSlice)(&cfg.Ignore), "ignore", "comma-separated or repeated directories or files to ignore")
+	flag.Var((*stringSlice)(&cfg.Ignore), "i", "comma-separated or repeated directories or files to ignore (shorthand)")
+	flag.DurationVar(&cfg.Debounce, "debounce", 100*time.Millisecond, "quiet window to collapse bursts of file events into one reload")
+	flag.DurationVar(&cfg.DebounceMax, "debounce-max", time.Second, "maximum time a reload can be deferred by continuous events")
+	flag.DurationVar(&cfg.StartupGrace, "startup-grace", 0, "after starting, hold reloads for this long and then send one if anything changed, e.g. 3s (0 disables)")
+	flag.Var(&opts.maxReloadRate, "max-reload-rate", "maximum reload rate, e.g. 1/s or 30/min; extra reloads are coalesced (default: unlimited)")
+	flag.DurationVar(&cfg.PingInterval, "ping-interval", 30*time.Second, "interval between WebSocket keepalive pings (0 disables)")
+	flag.DurationVar(&opts.shutdownTimeout, "shutdown-timeout", 5*time.Second, "how long to wait for open connections on shutdown before closing them")
+	flag.BoolVar(&cfg.NoWatch, "no-watch", false, "don't watch any files, reloading only on POST <path>/trigger, -poll-cmd or embedded Reload calls")
+	flag.BoolVar(&opts.selfTest, "self-test", false, "check that the watcher reports a change in each watch directory, then exit (nonzero on failure)")
+	flag.BoolVar(&cfg.HashCheck, "hash-check", false, "only reload when a changed file's content is actually different")
+	flag.StringVar(&cfg.Exec, "exec", "", "shell command to run before each reload; the reload is skipped if it fails ($REFRESH_FILE holds the changed path)")
+	flag.StringVar(&cfg.EventLog, "event-log", "", "append a JSON line with the time, path and coalesced event count of every reload to this file")
+	flag.StringVar(&cfg.PollCmd, "poll-cmd", "", "shell command to run every -poll-cmd-interval, reloading whenever its output changes, e.g. \"git rev-parse HEAD\"")
+	flag.DurationVar(&cfg.PollCmdInterval, "poll-cmd-interval", livereload.DefaultPollCmdInterval, "how often to run -poll-cmd")
+	flag.BoolVar(&cfg.DryRun, "dry-run", false, "log each change and whether it would reload, without notifying clients")
+	flag.DurationVar(&cfg.RecentReloadWindow, "recent-reload-window", 0, "send clients that connect within this long after a reload that reload, e.g. 300ms (0 disables)")
+	flag.BoolVar(&cfg.NoReconnectReload, "no-reconnect-reload", false, "don't have the bundled client reload the page when it reconnects after the server restarts")
+	flag.BoolVar(&cfg.Handshake, "handshake", true, "send a \"connected\" message to each client as soon as its WebSocket opens")
+	flag.BoolVar(&cfg.FocusedOnly, "focused-only", false, "only reload tabs whose page is visible; hidden tabs reload once they're shown again")
+	flag.BoolVar(&cfg.CacheBust, "cache-bust", false, "have the bundled client reload to the page URL with a fresh ?_reload=<timestamp> so cached pages are refetched; implies -json-messages")
+	flag.BoolVar(&cfg.HardReload, "hard-reload", false, "make every reload a hard reload that clears the page's caches first")
+	flag.Var((*stringSlice)(&cfg.HardReloadPatterns), "hard-reload-pattern", "comma-separated or repeated patterns of files whose changes trigger a hard reload, e.g. sw.js")
+	flag.Var((*stringSlice)(&cfg.HMRDirs), "hmr-dir", "comma-separated or repeated directories, relative to the watch directory, whose .js modules are re-imported instead of reloading the page (implies -json-messages)")
+	flag.BoolVar(&cfg.HotCSS, "hot-css", false, "swap changed stylesheets in place instead of reloading the page (implies -json-messages)")
+	flag.StringVar(&cfg.ReloadMessage, "reload-message", livereload.DefaultReloadMessage, "text of the plain reload message; ignored with -json-messages")
+	flag.BoolVar(&cfg.AppendPath, "append-path", false, `append the changed file's path to plain-text messages, e.g. "reload src/app.js"`)
+	flag.BoolVar(&cfg.JSONMessages, "json-messages", false, `send JSON reload messages with the changed path instead of plain "reload"`)
+	flag.BoolVar(&cfg.Poll, "poll", false, "detect changes by periodically scanning the tree instead of using native file events")
+	flag.DurationVar(&cfg.PollInterval, "poll-interval", livereload.DefaultPollInterval, "how often to scan the tree when -poll is set")
+	flag.BoolVar(&cfg.FollowSymlinks, "follow-symlinks", false, "also watch directories reached through symlinks")
+	flag.BoolVar(&cfg.Strict, "strict", false, "exit when a subdirectory can't be watched or read instead of skipping it")
+	flag.IntVar(&opts.maxDepth, "max-depth", -1, "how many directory levels below each watch root to watch; 0 watches only the root (default: unlimited)")
+	flag.IntVar(&cfg.MaxWatches, "max-watches", 0, "maximum number of directories to watch; deeper directories are skipped with a warning (0 means no limit)")
+	flag.DurationVar(&cfg.IdleTimeout, "idle-timeout", 0, "shut down once every WebSocket client has disconnected and none reconnects within this long (0 disables)")
+	flag.IntVar(&cfg.QueueSize, "queue-size", livereload.DefaultQueueSize, "messages queued per WebSocket client before the oldest is dropped")
+	flag.IntVar(&cfg.MaxClients, "max-clients", 0, "maximum number of connected WebSocket clients (0 means no limit)")
+	flag.DurationVar(&cfg.WriteTimeout, "write-timeout", 10*time.Second, "maximum time to write a message to a client before dropping it (0 disables)")
+	flag.DurationVar(&cfg.HTTPReadTimeout, "http-read-timeout", 10*time.Second, "maximum time to read a plain HTTP request, headers and body (0 disables)")
+	flag.DurationVar(&cfg.HTTPWriteTimeout, "http-write-timeout", 30*time.Second, "maximum time to write a plain HTTP response (0 disables)")
+	flag.DurationVar(&cfg.HTTPIdleTimeout, "http-idle-timeout", 2*time.Minute, "how long idle keep-alive connections stay open (0 means -http-read-timeout)")
+	flag.IntVar(&cfg.ReadBufferSize, "read-buffer", livereload.DefaultBufferSize, "WebSocket read buffer size in bytes (up to 1 MiB)")
+	flag.IntVar(&cfg.WriteBufferSize, "write-buffer", livereload.DefaultBufferSize, "WebSocket write buffer size in bytes (up to 1 MiB)")
+	flag.Int64Var(&cfg.MaxMessageSize, "max-message-size", livereload.DefaultMaxMessageSize, "largest message in bytes a WebSocket client may send; bigger ones close the connection")
+	flag.BoolVar(&cfg.Compress, "compress", false, "compress larger WebSocket messages with permessage-deflate when the client supports it")
+	flag.BoolVar(&cfg.Gzip, "gzip", true, "gzip the client script and -serve files for clients that accept it, except already compressed types")
+	flag.StringVar(&cfg.ServeDir, "serve", "", "serve static files from this directory with the live-reload script injected into HTML")
+	flag.BoolVar(&cfg.NotFoundOverlay, "not-found-overlay", false, "with -serve, answer missing files with a page that stays connected and reloads on the next change")
+	flag.StringVar(&cfg.IgnoreFile, "ignore-file", "", "gitignore-style file of patterns to ignore (default: .refreshignore in each watch directory)")
+	flag.Var((*stringSlice)(&cfg.WatchOps), "watch-ops", "comma-separated or repeated file operations that trigger reloads: write, create, remove, rename, chmod (default: all but chmod)")
+	flag.Var((*stringSlice)(&cfg.Extensions), "ext", "comma-separated list of file extensions that trigger a reload, e.g. .html,.css,.js (default: any)")
+	flag.Var((*stringSlice)(&cfg.AllowedOrigins), "allowed-origins", "comma-separated list of origins allowed to connect (default: $ALLOWED_ORIGINS, or any origin)")
+	flag.BoolVar(&cfg.SkipHidden, "skip-hidden", true, "skip files and directories whose name starts with a dot, such as .git and .cache")
+	flag.BoolVar(&cfg.NoDefaultIgnores, "no-default-ignores", false, "don't skip editor swap, backup and temp files such as *.swp, *~ and .#*")
+	flag.BoolVar(&cfg.UseGitignore, "use-gitignore", false, "also ignore paths listed in .gitignore files under the watch directory")
+	flag.StringVar(&cfg.DenyUserAgent, "deny-user-agent", "", "regular expression of User-Agents whose WebSocket upgrades are refused with 403, e.g. HeadlessChrome|UptimeRobot (default: allow all)")
+	flag.StringVar(&cfg.AuthToken, "auth-token", "", "token clients must pass as ?token= or a WebSocket subprotocol to connect (default: no token)")
+	flag.StringVar(&cfg.TriggerToken, "trigger-token", "", "token POST <path>/trigger requests must send in the X-Trigger-Token header (default: no token)")
+	flag.StringVar(&cfg.TLSCert, "tls-cert", "", "TLS certificate file; serves https/wss when set together with -tls-key")
+	flag.StringVar(&cfg.TLSKey, "tls-key", "", "TLS private key file; serves https/wss when set together with -tls-cert")
+	flag.BoolVar(&opts.printSnippet, "print-snippet", false, "print a <script> tag for the configured endpoint and exit")
+	flag.BoolVar(&opts.printConfig, "print-config", false, "print the resolved configuration as JSON and exit")
+	flag.StringVar(&opts.configFile, "config", "", "path to a JSON or YAML config file; command-line flags take precedence")
 }
 
-// watchFiles watches for file changes in the specified directory and notifies connected clients.
-func watchFiles(cfg *serverConfig, ctx context.Context) {
-	watcher, err := fsnotify.NewWatcher()
+// run applies the environment and config file on top of the parsed flags,
+// then either prints what was asked for or runs the server until interrupted.
+// Any error that should end the process is returned for main to report.
+func run(opts *options) error {
+	cfg := &opts.server
+	// Precedence is defaults < config file < environment < command line, so
+	// each layer only fills in flags that a higher one left unset
+	explicit := explicitFlags()
+	if err := applyEnv(explicit); err != nil {
+		return fmt.Errorf("applying environment: %w", err)
+	}
+	if opts.configFile != "" {
+		values, err := loadConfig(opts.configFile)
+		if err != nil {
+			return fmt.Errorf("loading config: %w", err)
+		}
+		if err := applyConfig(values, explicit); err != nil {
+			return fmt.Errorf("applying config: %w", err)
+		}
+	}
+	if opts.logJSON {
+		livereload.UseJSONLogging(os.Stderr)
+	}
+	cfg.MinReloadInterval = opts.maxReloadRate.interval
+	mounts, err := parseMounts(opts.mounts)
 	if err != nil {
-		log.Fatalf("Failed to create watcher: %v", err)
+		return err
+	}
+	cfg.Mounts = mounts
+	if opts.maxDepth >= 0 {
+		cfg.MaxDepth = opts.maxDepth + 1
 	}
-	defer watcher.Close()
 
-	// addDir recursively adds directories to the watcher, ignoring specified paths
-	var addDir func(dir string) error
-	addDir = func(dir string) error {
-		if shouldIgnore(cfg, dir) {
-			if cfg.verbose {
-				log.Printf("Ignoring directory: %s\n", dir)
-			}
-			return nil
+	// Fall back to the documented environment variable for allowed origins
+	if len(cfg.AllowedOrigins) == 0 {
+		if env := os.Getenv("ALLOWED_ORIGINS"); env != "" {
+			(*stringSlice)(&cfg.AllowedOrigins).Set(env)
 		}
-		contents, err := os.ReadDir(dir)
-		if err != nil {
-			return err
+	}
+	if opts.quiet {
+		cfg.LogLevel = "error"
+	}
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	// info logs the CLI's own progress messages unless -quiet is set
+	info := func(format string, args ...any) {
+		if cfg.LogLevel != "error" || cfg.Verbose {
+			log.Printf(format, args...)
 		}
-		for _, d := range contents {
-			if d.IsDir() {
-				path := filepath.Join(dir, d.Name())
-				if err := watcher.Add(path); err != nil {
-					return err
-				}
-				if cfg.verbose {
-					log.Printf("Watching directory: %s\n", path)
-				}
-				if err := addDir(path); err != nil {
-					return err
-				}
-			}
+	}
+	if dotenvMissing && !opts.printSnippet && !opts.printConfig {
+		info("No .env file found")
+	}
+
+	srv := livereload.New(*cfg)
+	if opts.printSnippet {
+		fmt.Print(srv.Snippet())
+		return nil
+	}
+	if opts.printConfig {
+		if err := printConfig(os.Stdout); err != nil {
+			return fmt.Errorf("printing config: %w", err)
 		}
 		return nil
 	}
 
-	if err := addDir(cfg.watchDir); err != nil {
-		log.Fatalf("Failed to add directory to watcher: %v", err)
+	// Setup signal handling for graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := srv.Start(ctx); err != nil {
+		return fmt.Errorf("starting server: %w", err)
 	}
 
-	// Listen for file change events and errors
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case event, ok := <-watcher.Events:
-			if !ok {
-				return
-			}
-			if cfg.verbose {
-				log.Println("Detected change:", event)
-			}
-			// Notify all connected clients to reload
-			for client, cancel := range cfg.clients {
-				err := client.WriteMessage(websocket.TextMessage, []byte("reload"))
-				if err != nil {
-					log.Printf("Error sending reload message: %v", err)
-					cancel() // Cancel context on error
-				}
-			}
-		case err, ok := <-watcher.Errors:
-			if !ok {
-				return
+	// Check that the watcher sees changes, then shut down either way
+	selfTest := make(chan error, 1)
+	if opts.selfTest {
+		go func() {
+			err := srv.SelfTest(selfTestTimeout)
+			if err == nil {
+				info("Self-test passed: the watcher reported changes in every watch directory")
 			}
-			log.Printf("Watcher error: %v", err)
-		}
+			selfTest <- err
+			stop()
+		}()
+	}
+
+	// Wait for an interrupt signal, or for every client to have left with
+	// -idle-timeout, to gracefully shutdown
+	select {
+	case <-ctx.Done():
+	case <-srv.Idle():
+		info("No clients connected for %s", cfg.IdleTimeout)
 	}
-}
 
-// shouldIgnore checks if a path should be ignored based on the server configuration.
-func shouldIgnore(cfg *serverConfig, path string) bool {
-	for _, ignore := range cfg.ignoreList {
-		if ignore == path {
-			return true
+	info("Shutting down server...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), opts.shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("Shutdown timed out after %s, remaining connections were closed", opts.shutdownTimeout)
+	} else if err != nil {
+		return fmt.Errorf("shutting down server: %w", err)
+	} else {
+		info("Server gracefully stopped")
+	}
+	select {
+	case err := <-selfTest:
+		if err != nil {
+			return fmt.Errorf("self-test failed: %w", err)
 		}
+	default:
 	}
-	return false
+	return nil
 }
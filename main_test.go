@@ -0,0 +1,34 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestStringSliceSet(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string // Each passed to Set in turn, like repeated flags
+		want   []string
+	}{
+		{"single", []string{"node_modules"}, []string{"node_modules"}},
+		{"comma-separated", []string{"a,b,c"}, []string{"a", "b", "c"}},
+		{"repeated", []string{"a", "b"}, []string{"a", "b"}},
+		{"mixed", []string{"a,b", "c", "d,e"}, []string{"a", "b", "c", "d", "e"}},
+		{"whitespace trimmed", []string{" a , b ", "\tc\n"}, []string{"a", "b", "c"}},
+		{"empty entries dropped", []string{"a,,b,", ",", " "}, []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s stringSlice
+			for _, v := range tt.values {
+				if err := s.Set(v); err != nil {
+					t.Fatalf("Set(%q): %v", v, err)
+				}
+			}
+			if !slices.Equal(s, tt.want) {
+				t.Errorf("got %q, want %q", s, tt.want)
+			}
+		})
+	}
+}